@@ -2,35 +2,184 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+/*
+The log's errors carry their gRPC status, so the server can return them to
+clients as they are. Each status has a standard code, an ErrorInfo detail
+whose reason clients can switch on and whose metadata holds the error's
+fields, and a LocalizedMessage detail to show to a person.
+*/
+const errorDomain = "proglog"
+
+/*
+newStatus(c, reason, msg, localized, metadata) builds an error's status with
+its details. If the details fail to marshal, we still return the bare status.
+*/
+func newStatus(
+	c codes.Code,
+	reason, msg, localized string,
+	metadata map[string]string,
+) *status.Status {
+	st := status.New(c, msg)
+	std, err := st.WithDetails(
+		&errdetails.ErrorInfo{
+			Reason:   reason,
+			Domain:   errorDomain,
+			Metadata: metadata,
+		},
+		&errdetails.LocalizedMessage{
+			Locale:  "en-US",
+			Message: localized,
+		},
+	)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+/*
+ErrOffsetOutOfRange is returned when there's no record at or after the
+requested offset, along with the log's range when we looked: Low is its
+lowest offset and High the offset its next record will get, so the offsets a
+consumer can read are those from Low up to, but not including, High.
+*/
 type ErrOffsetOutOfRange struct {
 	Offset uint64
+	Low    uint64
+	High   uint64
 }
 
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
-	st := status.New(
-		404,
+	return newStatus(
+		codes.OutOfRange,
+		"OFFSET_OUT_OF_RANGE",
 		fmt.Sprintf("offset out of range: %d", e.Offset),
+		fmt.Sprintf(
+			"The requested offset is outside the log's range: %d; the log holds offsets %d to %d, exclusive",
+			e.Offset, e.Low, e.High,
+		),
+		map[string]string{
+			"offset":      strconv.FormatUint(e.Offset, 10),
+			"low_offset":  strconv.FormatUint(e.Low, 10),
+			"high_offset": strconv.FormatUint(e.High, 10),
+		},
 	)
-	msg := fmt.Sprintf(
-		"The requested offset is outside the log's range: %d",
-		e.Offset,
-	)
-	d := &errdetails.LocalizedMessage{
-		Locale:  "en-US",
-		Message: msg,
-	}
-	std, err := st.WithDetails(d)
-	if err != nil {
-		return st
-	}
-	return std
 }
 
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+/*
+ErrCorruptRecord is returned when the record stored at an offset fails its
+checksum or was only partially written, so the bytes on disk can't be trusted.
+*/
+type ErrCorruptRecord struct {
+	Offset uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.DataLoss,
+		"CORRUPT_RECORD",
+		fmt.Sprintf("corrupt record at offset: %d", e.Offset),
+		fmt.Sprintf(
+			"The record stored at offset %d is corrupt and can't be read",
+			e.Offset,
+		),
+		map[string]string{
+			"offset": strconv.FormatUint(e.Offset, 10),
+		},
+	)
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrLogClosed is returned when the log has been closed, so it can't append or
+read records anymore.
+*/
+type ErrLogClosed struct{}
+
+func (e ErrLogClosed) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.FailedPrecondition,
+		"LOG_CLOSED",
+		"log closed",
+		"The log is closed and can't append or read records",
+		nil,
+	)
+}
+
+func (e ErrLogClosed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrRecordTooLarge is returned when a record, or a batch of records, is bigger
+than the log takes. Size is how big it is and Max the most the log takes,
+both counted in Unit: bytes, or records for a batch with more records than a
+segment holds.
+*/
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+	Unit string
+}
+
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.InvalidArgument,
+		"RECORD_TOO_LARGE",
+		fmt.Sprintf("record too large: %d %s, max %d", e.Size, e.Unit, e.Max),
+		fmt.Sprintf(
+			"The record is %d %s, more than the log's maximum of %d",
+			e.Size, e.Unit, e.Max,
+		),
+		map[string]string{
+			"size": strconv.FormatUint(e.Size, 10),
+			"max":  strconv.FormatUint(e.Max, 10),
+			"unit": e.Unit,
+		},
+	)
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+/*
+ErrUnavailable is returned when the log fails for a reason that has nothing
+to do with the request, like a failed write to or sync of its files, so the
+request may succeed if retried. Err is the underlying error.
+*/
+type ErrUnavailable struct {
+	Err error
+}
+
+func (e ErrUnavailable) GRPCStatus() *status.Status {
+	return newStatus(
+		codes.Unavailable,
+		"LOG_UNAVAILABLE",
+		fmt.Sprintf("log unavailable: %v", e.Err),
+		"The log couldn't complete the request; try again later",
+		nil,
+	)
+}
+
+func (e ErrUnavailable) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrUnavailable) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,32 @@
+/*
+gencert generates a CA and the server and client certificates it signs for
+running proglog with mutual TLS in development. By default it writes them to
+$HOME/.proglog.
+*/
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SStoyanov22/proglog/internal/config"
+)
+
+func main() {
+	home, _ := os.UserHomeDir()
+	dir := flag.String("dir", filepath.Join(home, ".proglog"), "directory to write the certificates to")
+	hosts := flag.String("hosts", "localhost,127.0.0.1", "comma-separated host names and IPs for the server certificate")
+	clients := flag.String("clients", "root,nobody", "comma-separated client names to make certificates for")
+	flag.Parse()
+
+	if err := config.GenerateCerts(
+		*dir,
+		strings.Split(*hosts, ","),
+		strings.Split(*clients, ",")...,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"text/tabwriter"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/SStoyanov22/proglog/internal/log"
+)
+
+/*
+logFlags are the flags every command takes to find the log and read its
+records.
+*/
+type logFlags struct {
+	dir    string
+	keyDir string
+}
+
+func (l *logFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&l.dir, "dir", "", "directory the log keeps its segments in")
+	fs.StringVar(&l.keyDir, "key-dir", "", "directory of the keys the log's records are encrypted with")
+}
+
+/*
+config() returns the log config to read the records with, which only needs
+the key provider if the records are encrypted.
+*/
+func (l *logFlags) config() (log.Config, error) {
+	var c log.Config
+	if l.dir == "" {
+		return c, fmt.Errorf("-dir is required")
+	}
+	if l.keyDir != "" {
+		kp, err := log.NewFileKeyProvider(l.keyDir)
+		if err != nil {
+			return c, err
+		}
+		c.Encryption.KeyProvider = kp
+	}
+	return c, nil
+}
+
+/*
+segments prints a line for each segment in the log, and whether the log was
+shut down cleanly.
+*/
+func segments(args []string, stdout io.Writer) error {
+	var l logFlags
+	fs := flag.NewFlagSet("segments", flag.ContinueOnError)
+	l.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := l.config(); err != nil {
+		return err
+	}
+	in, err := log.Inspect(l.dir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BASE\tNEXT\tRECORDS\tSTORE BYTES\tINDEX BYTES\tTIME INDEX BYTES")
+	for _, s := range in.Segments {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\n",
+			s.BaseOffset, s.NextOffset, s.Records, s.StoreBytes, s.IndexBytes,
+			s.TimeIndexBytes)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if !in.Clean {
+		_, err = fmt.Fprintln(stdout, "the log wasn't shut down cleanly; it recovers its segments when it next starts")
+	}
+	return err
+}
+
+/*
+jsonRecord is how records prints a record with -format json. The key and
+value are bytes, which encode as base64, like proglogctl's, so that a value
+that isn't UTF-8 comes out as it went in.
+*/
+type jsonRecord struct {
+	Offset    uint64    `json:"offset"`
+	Timestamp time.Time `json:"timestamp"`
+	Key       []byte    `json:"key,omitempty"`
+	Value     []byte    `json:"value"`
+}
+
+/*
+records prints the records from -from to -to, inclusive, one per line, as the
+raw value, the hex-encoded value, or the whole record as a JSON object.
+*/
+func records(args []string, stdout io.Writer) error {
+	var l logFlags
+	fs := flag.NewFlagSet("records", flag.ContinueOnError)
+	l.register(fs)
+	from := fs.Uint64("from", 0, "offset of the first record to print")
+	to := fs.Uint64("to", math.MaxUint64, "offset of the last record to print")
+	format := fs.String("format", "raw", "how to print records: raw, hex or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := l.config()
+	if err != nil {
+		return err
+	}
+	var printRecord func(*api.Record) error
+	switch *format {
+	case "raw":
+		printRecord = func(r *api.Record) error {
+			_, err := fmt.Fprintf(stdout, "%s\n", r.Value)
+			return err
+		}
+	case "hex":
+		printRecord = func(r *api.Record) error {
+			_, err := fmt.Fprintln(stdout, hex.EncodeToString(r.Value))
+			return err
+		}
+	case "json":
+		enc := json.NewEncoder(stdout)
+		printRecord = func(r *api.Record) error {
+			return enc.Encode(jsonRecord{
+				Offset:    r.Offset,
+				Timestamp: r.Timestamp.AsTime(),
+				Key:       r.Key,
+				Value:     r.Value,
+			})
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	return log.Records(l.dir, c, *from, *to, printRecord)
+}
+
+/*
+verify prints each problem it finds with the log and fails if there are any.
+*/
+func verify(args []string, stdout io.Writer) error {
+	var l logFlags
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	l.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := l.config()
+	if err != nil {
+		return err
+	}
+	problems, err := log.Verify(l.dir, c)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		if _, err = fmt.Fprintln(stdout, p); err != nil {
+			return err
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems; repair rebuilds the indexes and truncates a corrupt tail", len(problems))
+	}
+	_, err = fmt.Fprintln(stdout, "ok")
+	return err
+}
+
+/*
+repair rebuilds the log's indexes and truncates corrupt tails, and prints what
+it did.
+*/
+func repair(args []string, stdout io.Writer) error {
+	var l logFlags
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	l.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := l.config()
+	if err != nil {
+		return err
+	}
+	r, err := log.Repair(l.dir, c)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout,
+		"rebuilt %d segments' indexes with %d records and truncated %d bytes\n",
+		r.Segments, r.Records, r.TruncatedBytes)
+	return err
+}
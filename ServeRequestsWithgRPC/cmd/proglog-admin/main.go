@@ -0,0 +1,68 @@
+/*
+proglog-admin inspects and repairs a log's directory while no server is
+running it.
+
+	proglog-admin segments -dir DIR
+	proglog-admin records -dir DIR [-from N] [-to N] [-format raw|hex|json]
+	proglog-admin verify -dir DIR
+	proglog-admin repair -dir DIR
+
+segments prints each segment's base and next offsets, file sizes and record
+count. records prints the records in an offset range, read straight from the
+stores. verify checks that every index entry points at a whole frame holding
+its record and that every record in the stores is indexed, and exits with an
+error if it finds a problem. repair rebuilds the indexes from the stores and
+truncates any corrupt tail, as the log does after an unclean shutdown. Give
+-key-dir to read a log whose records are encrypted. Run a command with -h for
+its flags.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglog-admin:", err)
+		os.Exit(1)
+	}
+}
+
+var commands = map[string]func(args []string, stdout io.Writer) error{
+	"segments": segments,
+	"records":  records,
+	"verify":   verify,
+	"repair":   repair,
+}
+
+const usage = "usage: proglog-admin segments|records|verify|repair [flags]"
+
+/*
+run(args, stdout) runs the command the arguments name. Asking for help, for
+the commands or a command's flags, returns flag.ErrHelp once we've printed it,
+so that main exits successfully, as the flag package does.
+*/
+func run(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "-h", "-help", "--help":
+		fmt.Fprintln(stdout, usage)
+		return flag.ErrHelp
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return cmd(args[1:], stdout)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/SStoyanov22/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+TestCommands(*testing.T) runs the commands against a closed log: listing its
+segments, printing a range of records, and verifying and repairing it.
+*/
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proglog-admin-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 24
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = clog.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, clog.Close())
+
+	admin := func(args ...string) string {
+		var stdout bytes.Buffer
+		args = append(args[:1:1], append([]string{"-dir", dir}, args[1:]...)...)
+		require.NoError(t, run(args, &stdout))
+		return stdout.String()
+	}
+
+	lines := strings.Split(strings.TrimSpace(admin("segments")), "\n")
+	require.Equal(t, 3, len(lines))
+	require.Equal(t, []string{"0", "2", "2"}, strings.Fields(lines[1])[:3])
+	require.Equal(t, []string{"2", "3", "1"}, strings.Fields(lines[2])[:3])
+
+	require.Equal(t, "record 1\nrecord 2\n", admin("records", "-from", "1", "-to", "2"))
+	require.Equal(t, "7265636f72642030\n", admin("records", "-to", "0", "-format", "hex"))
+	require.Equal(t, "ok\n", admin("verify"))
+	require.Equal(t,
+		"rebuilt 2 segments' indexes with 3 records and truncated 0 bytes\n",
+		admin("repair"),
+	)
+
+	require.Error(t, run([]string{"segments"}, ioutil.Discard))
+	require.Error(t, run([]string{"records", "-dir", dir, "-format", "xml"}, ioutil.Discard))
+	require.Error(t, run([]string{"unknown"}, ioutil.Discard))
+	require.ErrorIs(t, run([]string{"-h"}, ioutil.Discard), flag.ErrHelp)
+	require.ErrorIs(t, run([]string{"verify", "-h"}, ioutil.Discard), flag.ErrHelp)
+}
+
+/*
+TestRecordsJSON(*testing.T) tests that records prints a record's key and
+value as base64 with -format json, so that a value that isn't UTF-8 decodes
+back to the bytes that were appended.
+*/
+func TestRecordsJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proglog-admin-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	want := &api.Record{Key: []byte("key"), Value: []byte{0xff, 0xfe, 0x00, 0x80}}
+	_, err = clog.Append(want)
+	require.NoError(t, err)
+	require.NoError(t, clog.Close())
+
+	var stdout bytes.Buffer
+	require.NoError(t, run([]string{"records", "-dir", dir, "-format", "json"}, &stdout))
+	var got jsonRecord
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &got))
+	require.Equal(t, uint64(0), got.Offset)
+	require.Equal(t, want.Key, got.Key)
+	require.Equal(t, want.Value, got.Value)
+}
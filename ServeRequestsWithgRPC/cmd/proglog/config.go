@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+cfg is the server's configuration. It's read from a YAML file, if one is
+given with -config, and any flag given on the command line overrides the
+file's value for it.
+*/
+type cfg struct {
+	DataDir       string `yaml:"data-dir"`
+	BindAddr      string `yaml:"bind-addr"`
+	AdminAddr     string `yaml:"admin-addr"`
+	ACLPolicyFile string `yaml:"acl-policy-file"`
+	// ShutdownTimeout is how long we give requests to finish on shutdown
+	// before we cut them off.
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+	// MaxRecordBytes is the largest record the server takes; zero
+	// defaults it to the segment's max store bytes.
+	MaxRecordBytes uint64 `yaml:"max-record-bytes"`
+	Segment        struct {
+		MaxStoreBytes uint64        `yaml:"max-store-bytes"`
+		MaxIndexBytes uint64        `yaml:"max-index-bytes"`
+		InitialOffset uint64        `yaml:"initial-offset"`
+		MaxAge        time.Duration `yaml:"max-age"`
+	} `yaml:"segment"`
+	TLS struct {
+		CertFile string `yaml:"cert-file"`
+		KeyFile  string `yaml:"key-file"`
+		CAFile   string `yaml:"ca-file"`
+	} `yaml:"tls"`
+}
+
+/*
+parseConfig(args []string) parses the command line. We parse the flags twice:
+first to find the config file, and again after reading the file, so that the
+flags given on the command line win over the file while the flags' defaults
+don't.
+*/
+func parseConfig(args []string) (*cfg, error) {
+	c := &cfg{}
+	fs := flag.NewFlagSet("proglog", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to a YAML config file")
+	fs.StringVar(&c.DataDir, "data-dir", "/var/lib/proglog", "directory to store the log's segments in")
+	fs.StringVar(&c.BindAddr, "bind-addr", "127.0.0.1:8400", "address to serve gRPC on")
+	fs.StringVar(&c.AdminAddr, "admin-addr", "", "address to serve the Admin service on; empty doesn't serve it")
+	fs.StringVar(&c.ACLPolicyFile, "acl-policy-file", "", "path to the ACL policy file; empty lets every client produce and consume")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to let requests finish on shutdown")
+	fs.Uint64Var(&c.MaxRecordBytes, "max-record-bytes", 0, "largest record to take; 0 defaults to the segment's max store bytes")
+	fs.Uint64Var(&c.Segment.MaxStoreBytes, "segment-max-store-bytes", 1<<20, "max size of a segment's store")
+	fs.Uint64Var(&c.Segment.MaxIndexBytes, "segment-max-index-bytes", 1<<20, "max size of a segment's index")
+	fs.Uint64Var(&c.Segment.InitialOffset, "segment-initial-offset", 0, "offset of the log's first record")
+	fs.DurationVar(&c.Segment.MaxAge, "segment-max-age", 0, "roll segments once they're this old; 0 disables")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert-file", "", "path to the server's TLS certificate")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key-file", "", "path to the server's TLS key")
+	fs.StringVar(&c.TLS.CAFile, "tls-ca-file", "", "path to the CA that signs client certificates, for mutual TLS")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configFile == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, fs.Parse(args)
+}
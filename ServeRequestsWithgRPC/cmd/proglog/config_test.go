@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+/*
+TestParseConfig(*testing.T) tests that the config file overrides the flags'
+defaults and the flags given on the command line override the file.
+*/
+func TestParseConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "proglog-config")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+data-dir: /tmp/proglog
+bind-addr: 127.0.0.1:9400
+admin-addr: 127.0.0.1:9401
+max-record-bytes: 2048
+segment:
+  max-store-bytes: 4096
+  max-age: 1h
+tls:
+  cert-file: server.pem
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	c, err := parseConfig([]string{
+		"-config", f.Name(),
+		"-bind-addr", "127.0.0.1:9500",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "/tmp/proglog", c.DataDir)
+	require.Equal(t, "127.0.0.1:9500", c.BindAddr)
+	require.Equal(t, "127.0.0.1:9401", c.AdminAddr)
+	require.Equal(t, uint64(2048), c.MaxRecordBytes)
+	require.Equal(t, uint64(4096), c.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(1<<20), c.Segment.MaxIndexBytes)
+	require.Equal(t, time.Hour, c.Segment.MaxAge)
+	require.Equal(t, "server.pem", c.TLS.CertFile)
+	require.Equal(t, 10*time.Second, c.ShutdownTimeout)
+}
@@ -0,0 +1,170 @@
+/*
+proglog serves a commit log over gRPC. It's configured with a YAML file,
+flags, or both; run it with -h for the flags. On SIGINT or SIGTERM, it stops
+taking requests, ends the consume streams, gives the requests in flight time
+to finish, and then closes the log so it starts cleanly next time. Given
+-admin-addr, it also serves the Admin service, for managing the log's
+segments, on that address.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	stdlog "log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/SStoyanov22/proglog/internal/auth"
+	"github.com/SStoyanov22/proglog/internal/config"
+	"github.com/SStoyanov22/proglog/internal/log"
+	"github.com/SStoyanov22/proglog/internal/server"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	c, err := parseConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglog:", err)
+		os.Exit(2)
+	}
+	if err = run(c); err != nil {
+		stdlog.Fatal(err)
+	}
+}
+
+func run(c *cfg) error {
+	if err := os.MkdirAll(c.DataDir, 0755); err != nil {
+		return err
+	}
+	logConfig := log.Config{}
+	logConfig.MaxRecordBytes = c.MaxRecordBytes
+	logConfig.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	logConfig.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	logConfig.Segment.InitialOffset = c.Segment.InitialOffset
+	logConfig.Segment.MaxAge = c.Segment.MaxAge
+	clog, err := log.NewLog(c.DataDir, logConfig)
+	if err != nil {
+		return err
+	}
+	if r := clog.Recovery(); r != nil {
+		stdlog.Printf(
+			"recovered %d segments with %d records, discarded %d bytes",
+			r.Segments, r.Records, r.TruncatedBytes,
+		)
+	}
+	// however serving ends, we close the log, so that it writes its clean
+	// shutdown marker and the next start doesn't recover it for nothing
+	err = serve(c, clog)
+	if cerr := clog.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/*
+serve(c, clog) serves the log, and the Admin service if configured, until we
+get a signal to shut down or a server fails.
+*/
+func serve(c *cfg, clog *log.Log) error {
+	var err error
+	draining := make(chan struct{})
+	serverConfig := &server.Config{
+		CommitLog:      clog,
+		Draining:       draining,
+		MaxRecordBytes: int(clog.Config.MaxRecordBytes),
+	}
+	if c.TLS.CertFile != "" {
+		serverConfig.TLS, err = config.SetupTLSConfig(config.TLSConfig{
+			CertFile: c.TLS.CertFile,
+			KeyFile:  c.TLS.KeyFile,
+			CAFile:   c.TLS.CAFile,
+			Server:   true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if c.ACLPolicyFile != "" {
+		if serverConfig.Authorizer, err = auth.New(c.ACLPolicyFile); err != nil {
+			return err
+		}
+	}
+	gsrv, err := server.NewGRPCServer(serverConfig)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", c.BindAddr)
+	if err != nil {
+		return err
+	}
+
+	served := make(chan error, 2)
+	go func() {
+		served <- gsrv.Serve(ln)
+	}()
+	stdlog.Printf("serving on %s", ln.Addr())
+
+	// the admin server shares the log server's TLS config and policy, so
+	// only subjects allowed the admin action can use it
+	var asrv *grpc.Server
+	if c.AdminAddr != "" {
+		asrv, err = server.NewAdminServer(&server.AdminConfig{
+			Log:        clog,
+			TLS:        serverConfig.TLS,
+			Authorizer: serverConfig.Authorizer,
+		})
+		if err != nil {
+			gsrv.Stop()
+			return err
+		}
+		aln, err := net.Listen("tcp", c.AdminAddr)
+		if err != nil {
+			gsrv.Stop()
+			return err
+		}
+		go func() {
+			served <- asrv.Serve(aln)
+		}()
+		stdlog.Printf("serving admin on %s", aln.Addr())
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigc:
+		stdlog.Printf("received %s, shutting down", sig)
+	case err = <-served:
+		gsrv.Stop()
+		if asrv != nil {
+			asrv.Stop()
+		}
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	if asrv != nil {
+		asrv.GracefulStop()
+	}
+
+	close(draining)
+	stopped := make(chan struct{})
+	go func() {
+		gsrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(c.ShutdownTimeout):
+		stdlog.Printf("requests still running after %s, stopping", c.ShutdownTimeout)
+		gsrv.Stop()
+		<-stopped
+	}
+	return nil
+}
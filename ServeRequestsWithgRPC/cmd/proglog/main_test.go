@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/SStoyanov22/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+TestRunClosesLogOnFailure(*testing.T) tests that when the server fails to start
+after the log is open, run closes the log, so that the next start finds it
+shut down cleanly and has nothing to recover.
+*/
+func TestRunClosesLogOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proglog-run")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := parseConfig([]string{
+		"-data-dir", dir,
+		"-bind-addr", "127.0.0.1:0",
+		"-acl-policy-file", path.Join(dir, "missing.csv"),
+	})
+	require.NoError(t, err)
+	require.Error(t, run(c))
+
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	require.Nil(t, l.Recovery())
+}
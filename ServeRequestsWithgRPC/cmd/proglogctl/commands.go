@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+stringsFlag collects a flag given more than once.
+*/
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+/*
+produce appends records to the log over a produce stream and prints each
+one's offset.
+*/
+func produce(args []string, stdin io.Reader, stdout io.Writer) error {
+	var c clientFlags
+	var files stringsFlag
+	fs := flag.NewFlagSet("produce", flag.ContinueOnError)
+	c.register(fs)
+	key := fs.String("key", "", "key to give every record")
+	fs.Var(&files, "file", "file whose contents to produce as a record; may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cc, client, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	stream, err := client.ProduceStream(context.Background())
+	if err != nil {
+		return err
+	}
+	send := func(value []byte) error {
+		record := &api.Record{Value: value}
+		if *key != "" {
+			record.Key = []byte(*key)
+		}
+		if err := stream.Send(&api.ProduceRequest{Record: record}); err != nil {
+			return err
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(stdout, res.Offset)
+		return err
+	}
+
+	switch {
+	case fs.NArg() > 0:
+		for _, value := range fs.Args() {
+			if err = send([]byte(value)); err != nil {
+				return err
+			}
+		}
+	case len(files) > 0:
+		for _, name := range files {
+			b, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			if err = send(b); err != nil {
+				return err
+			}
+		}
+	default:
+		// a bufio.Scanner can't read lines longer than its buffer, and a
+		// record can be much larger, so we read the lines whole
+		r := bufio.NewReader(stdin)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				line = bytes.TrimSuffix(line, []byte("\n"))
+				line = bytes.TrimSuffix(line, []byte("\r"))
+				if err := send(line); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return stream.CloseSend()
+}
+
+/*
+consume prints -n records from -offset on. Compaction can leave gaps in the
+offsets, so we carry on from after each record we get rather than counting
+offsets, and we stop early at the end of the log.
+*/
+func consume(args []string, stdin io.Reader, stdout io.Writer) error {
+	var c clientFlags
+	fs := flag.NewFlagSet("consume", flag.ContinueOnError)
+	c.register(fs)
+	offset := fs.Uint64("offset", 0, "offset to consume from")
+	n := fs.Int("n", 1, "number of records to consume")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	printRecord, err := c.printer(stdout)
+	if err != nil {
+		return err
+	}
+	cc, client, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	_, err = consumeRange(client, *offset, *n, printRecord)
+	return err
+}
+
+/*
+consumeRange(client, offset, n, printRecord) prints up to n records from the offset
+on and returns the offset after the last one it printed. Reaching the end of
+the log isn't an error, except before the first record.
+*/
+func consumeRange(
+	client api.LogClient,
+	offset uint64,
+	n int,
+	printRecord func(*api.Record) error,
+) (uint64, error) {
+	for i := 0; i < n; i++ {
+		res, err := client.Consume(context.Background(), &api.ConsumeRequest{
+			Offset: offset,
+		})
+		if i > 0 && isOutOfRange(err) {
+			break
+		}
+		if err != nil {
+			return offset, err
+		}
+		if err = printRecord(res.Record); err != nil {
+			return offset, err
+		}
+		offset = res.Record.Offset + 1
+	}
+	return offset, nil
+}
+
+/*
+tail prints the last -n records in the log and, with -f, follows the log,
+printing records as they're appended until interrupted.
+*/
+func tail(args []string, stdin io.Reader, stdout io.Writer) error {
+	var c clientFlags
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	c.register(fs)
+	n := fs.Uint64("n", 10, "number of records to print from the end of the log")
+	follow := fs.Bool("f", false, "keep printing records as they're appended")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	printRecord, err := c.printer(stdout)
+	if err != nil {
+		return err
+	}
+	cc, client, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	offsets, err := client.GetOffsets(context.Background(), &api.GetOffsetsRequest{})
+	if err != nil {
+		return err
+	}
+	offset := offsets.LowOffset
+	if offsets.HighOffset-offset > *n {
+		offset = offsets.HighOffset - *n
+	}
+	if !*follow {
+		if offset == offsets.HighOffset {
+			return nil
+		}
+		_, err = consumeRange(client, offset, int(offsets.HighOffset-offset), printRecord)
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: offset})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF || status.Code(err) == codes.Canceled {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = printRecord(res.Record); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+isOutOfRange(err error) reports whether the server said the offset is past
+the end of the log, which it does with the OutOfRange code.
+*/
+func isOutOfRange(err error) bool {
+	return status.Code(err) == codes.OutOfRange
+}
@@ -0,0 +1,62 @@
+/*
+proglogctl produces records to and consumes records from a proglog server.
+
+	proglogctl produce [flags] [value...]
+	proglogctl consume [flags] -offset N
+	proglogctl tail [flags] [-n N] [-f]
+
+produce appends each value given as an argument, or each file given with
+-file, or, with neither, each line read from stdin. consume prints records
+from an offset on, and tail prints the last records in the log and, with -f,
+keeps printing records as they're appended. Run a command with -h for its
+flags.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglogctl:", err)
+		os.Exit(1)
+	}
+}
+
+var commands = map[string]func(args []string, stdin io.Reader, stdout io.Writer) error{
+	"produce": produce,
+	"consume": consume,
+	"tail":    tail,
+}
+
+const usage = "usage: proglogctl produce|consume|tail [flags]"
+
+/*
+run(args, stdin, stdout) runs the command the arguments name. Asking for help,
+for the commands or a command's flags, returns flag.ErrHelp once we've printed
+it, so that main exits successfully, as the flag package does.
+*/
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "-h", "-help", "--help":
+		fmt.Fprintln(stdout, usage)
+		return flag.ErrHelp
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return cmd(args[1:], stdin, stdout)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/SStoyanov22/proglog/internal/log"
+	"github.com/SStoyanov22/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+TestCommands(*testing.T) runs the commands against a server: producing from
+arguments, stdin and files, and consuming and tailing in each format.
+*/
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proglogctl-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(path.Join(dir, "log"), 0755))
+	c := log.Config{}
+	c.MaxRecordBytes = 1024 * 1024
+	clog, err := log.NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer clog.Close()
+	gsrv, err := server.NewGRPCServer(&server.Config{CommitLog: clog})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+
+	ctl := func(stdin string, args ...string) string {
+		var stdout bytes.Buffer
+		args = append(args[:1:1], append([]string{"-addr", l.Addr().String()}, args[1:]...)...)
+		require.NoError(t, run(args, strings.NewReader(stdin), &stdout))
+		return stdout.String()
+	}
+
+	require.Equal(t, "0\n1\n", ctl("", "produce", "first", "second"))
+	require.Equal(t, "2\n3\n", ctl("third\nfourth\n", "produce", "-key", "k"))
+	file := path.Join(dir, "fifth")
+	require.NoError(t, ioutil.WriteFile(file, []byte("fifth"), 0644))
+	require.Equal(t, "4\n", ctl("", "produce", "-file", file))
+
+	require.Equal(t, "second\nthird\n", ctl("", "consume", "-offset", "1", "-n", "2"))
+	require.Equal(t, "6669667468\n", ctl("", "consume", "-offset", "4", "-n", "5", "-format", "hex"))
+
+	var record jsonRecord
+	out := ctl("", "consume", "-offset", "2", "-format", "json")
+	require.NoError(t, json.Unmarshal([]byte(out), &record))
+	require.Equal(t, uint64(2), record.Offset)
+	require.Equal(t, []byte("k"), record.Key)
+	require.Equal(t, []byte("third"), record.Value)
+	require.NotEmpty(t, record.Timestamp)
+
+	require.Equal(t, "fourth\nfifth\n", ctl("", "tail", "-n", "2"))
+	require.Equal(t, "first\nsecond\nthird\nfourth\nfifth\n", ctl("", "tail"))
+
+	// lines longer than a bufio.Scanner's buffer, and binary values
+	long := strings.Repeat("x", 100*1024)
+	require.Equal(t, "5\n6\n", ctl(long+"\r\nlast", "produce"))
+	require.Equal(t, long+"\nlast\n", ctl("", "consume", "-offset", "5", "-n", "2"))
+	binary := path.Join(dir, "binary")
+	require.NoError(t, ioutil.WriteFile(binary, []byte{0xff, 0x00, 0xfe}, 0644))
+	require.Equal(t, "7\n", ctl("", "produce", "-file", binary))
+	out = ctl("", "consume", "-offset", "7", "-format", "json")
+	require.NoError(t, json.Unmarshal([]byte(out), &record))
+	require.Equal(t, []byte{0xff, 0x00, 0xfe}, record.Value)
+
+	require.Error(t, run([]string{"consume", "-format", "xml"}, nil, ioutil.Discard))
+	require.Error(t, run([]string{"unknown"}, nil, ioutil.Discard))
+	err = run([]string{"consume", "-addr", l.Addr().String(), "-tls-cert-file", "client.pem"}, nil, ioutil.Discard)
+	require.EqualError(t, err, "-tls-cert-file and -tls-key-file need -tls-ca-file")
+	require.ErrorIs(t, run([]string{"-h"}, nil, ioutil.Discard), flag.ErrHelp)
+	require.ErrorIs(t, run([]string{"tail", "-h"}, nil, ioutil.Discard), flag.ErrHelp)
+}
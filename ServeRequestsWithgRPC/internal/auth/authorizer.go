@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Wildcard matches any subject, object or action in a policy.
+*/
+const Wildcard = "*"
+
+/*
+Authorizer decides what each subject may do with a policy of rules, each
+saying that a subject may perform an action on an object. A subject may do
+only what a rule allows it to do; anything else is denied. A client that
+didn't authenticate has no subject, and is denied everything, even by rules
+whose subject is the wildcard.
+*/
+type Authorizer struct {
+	rules []rule
+}
+
+type rule struct {
+	subject, object, action string
+}
+
+/*
+New(policyFile string) creates an authorizer with the policy in the given
+file. The file has one rule per line, as a comma-separated subject, object
+and action, any of which may be the "*" wildcard; for example "root, *, *"
+lets root do anything, and "nobody, *, consume" lets nobody only consume.
+Blank lines and lines starting with # are ignored; a rule with an empty field
+is an error.
+*/
+func New(policyFile string) (*Authorizer, error) {
+	f, err := os.Open(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a := &Authorizer{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf(
+				"%s:%d: want subject, object and action, got %q",
+				policyFile, n, line,
+			)
+		}
+		r := rule{
+			subject: strings.TrimSpace(fields[0]),
+			object:  strings.TrimSpace(fields[1]),
+			action:  strings.TrimSpace(fields[2]),
+		}
+		if r.subject == "" || r.object == "" || r.action == "" {
+			return nil, fmt.Errorf(
+				"%s:%d: empty subject, object or action in %q",
+				policyFile, n, line,
+			)
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a, scanner.Err()
+}
+
+/*
+Authorize(subject, object, action string) returns nil if the policy lets the
+subject perform the action on the object, and a PermissionDenied status error
+if it doesn't.
+*/
+func (a *Authorizer) Authorize(subject, object, action string) error {
+	if subject == "" {
+		msg := fmt.Sprintf(
+			"unauthenticated client not permitted to %s to %s",
+			action,
+			object,
+		)
+		return status.New(codes.PermissionDenied, msg).Err()
+	}
+	for _, r := range a.rules {
+		if match(r.subject, subject) &&
+			match(r.object, object) &&
+			match(r.action, action) {
+			return nil
+		}
+	}
+	msg := fmt.Sprintf(
+		"%s not permitted to %s to %s",
+		subject,
+		action,
+		object,
+	)
+	st := status.New(codes.PermissionDenied, msg)
+	return st.Err()
+}
+
+func match(pattern, value string) bool {
+	return pattern == Wildcard || pattern == value
+}
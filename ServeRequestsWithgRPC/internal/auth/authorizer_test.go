@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorizer(t *testing.T) {
+	f, err := ioutil.TempFile("", "policy")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`# subject, object, action
+root, *, *
+
+nobody, topic, produce
+*, log, consume
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	a, err := New(f.Name())
+	require.NoError(t, err)
+	require.NoError(t, a.Authorize("root", "log", "produce"))
+	require.NoError(t, a.Authorize("nobody", "log", "consume"))
+	require.NoError(t, a.Authorize("someone", "log", "consume"))
+	require.NoError(t, a.Authorize("nobody", "topic", "produce"))
+	for _, subject := range []string{"nobody", "", "someone"} {
+		err = a.Authorize(subject, "log", "produce")
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	}
+	// the wildcard doesn't match a client that didn't authenticate
+	err = a.Authorize("", "log", "consume")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	for _, policy := range []string{"root, *\n", ", *, consume\n"} {
+		require.NoError(t, ioutil.WriteFile(f.Name(), []byte(policy), 0644))
+		_, err = New(f.Name())
+		require.Error(t, err)
+	}
+}
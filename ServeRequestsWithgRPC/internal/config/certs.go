@@ -0,0 +1,132 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+CertFile(dir, name string) and KeyFile(dir, name string) return the paths
+GenerateCerts writes the named certificate and its key to: the CA is "ca",
+the server is "server", and each client is "<client>-client".
+*/
+func CertFile(dir, name string) string {
+	return filepath.Join(dir, name+".pem")
+}
+
+func KeyFile(dir, name string) string {
+	return filepath.Join(dir, name+"-key.pem")
+}
+
+/*
+GenerateCerts(dir string, hosts []string, clients ...string) generates a
+certificate authority, a server certificate for the given host names and IP
+addresses, and a client certificate for each of the given clients, all signed
+by the CA, and writes them to dir. Each client's name becomes its
+certificate's common name, which is the subject the server knows it by. The
+certificates are for development and tests, where we don't want to depend on
+an external tool to make them: use certificates from your own CA in
+production.
+*/
+func GenerateCerts(dir string, hosts []string, clients ...string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	ca := template("proglog CA")
+	ca.IsCA = true
+	ca.BasicConstraintsValid = true
+	ca.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	if err = writeCert(dir, "ca", ca, ca, caKey, caKey); err != nil {
+		return err
+	}
+
+	server := template("server")
+	server.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	if err = writeSignedCert(dir, "server", server, ca, caKey); err != nil {
+		return err
+	}
+
+	for _, client := range clients {
+		cert := template(client)
+		cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		if err = writeSignedCert(dir, client+"-client", cert, ca, caKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func template(commonName string) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"proglog"},
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+	}
+}
+
+func writeSignedCert(
+	dir, name string,
+	cert, ca *x509.Certificate,
+	caKey crypto.Signer,
+) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	return writeCert(dir, name, cert, ca, key, caKey)
+}
+
+/*
+writeCert signs the certificate for the given key with the CA's key and writes
+both out as PEM files.
+*/
+func writeCert(
+	dir, name string,
+	cert, ca *x509.Certificate,
+	key *ecdsa.PrivateKey,
+	caKey crypto.Signer,
+) error {
+	der, err := x509.CreateCertificate(rand.Reader, cert, ca, key.Public(), caKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = writePEM(CertFile(dir, name), "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	return writePEM(KeyFile(dir, name), "EC PRIVATE KEY", keyDER, 0600)
+}
+
+func writePEM(name, typ string, b []byte, perm os.FileMode) error {
+	return os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), perm)
+}
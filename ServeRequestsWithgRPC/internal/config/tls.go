@@ -0,0 +1,61 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+/*
+TLSConfig describes the certificates one side of a connection uses. CertFile
+and KeyFile are its own certificate and key, which it presents to the other
+side, and CAFile is the certificate authority it verifies the other side's
+certificate with. Server says which side of the connection this is, and
+ServerAddress is the name a client expects the server's certificate to have.
+*/
+type TLSConfig struct {
+	CertFile      string
+	KeyFile       string
+	CAFile        string
+	ServerAddress string
+	Server        bool
+}
+
+/*
+SetupTLSConfig(cfg TLSConfig) builds a *tls.Config from the given files. Every
+field is optional: a client with no certificate of its own can still verify
+the server with the CA, and a server with a CA requires and verifies its
+clients' certificates, which is what gives us mutual TLS and lets the server
+know who each client is.
+*/
+func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		b, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		ca := x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf(
+				"failed to parse root certificate: %q", cfg.CAFile,
+			)
+		}
+		if cfg.Server {
+			tlsConfig.ClientCAs = ca
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.RootCAs = ca
+		}
+		tlsConfig.ServerName = cfg.ServerAddress
+	}
+	return tlsConfig, nil
+}
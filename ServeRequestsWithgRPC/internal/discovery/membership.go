@@ -0,0 +1,752 @@
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+Membership tracks which servers are in the cluster. Each server runs a member
+that gossips with the others, like Serf does, so every server finds out when
+another joins, leaves or fails without a central registry, and calls its
+handler to react, say by starting or stopping replication from it.
+
+Every member keeps a table of the members it knows of, each with a heartbeat
+that only the member itself increments. Each gossip interval, a member bumps
+its heartbeat and sends its table over UDP to a few members picked at random,
+which merge it into theirs, keeping the newest state of each member, and send
+theirs back. So the heartbeats spread through the cluster, and a member whose
+heartbeat stands still for the failure timeout is taken for failed. A member
+that leaves sends its table one last time marked as left, so that the others
+see it leave rather than fail. Once a member has been gone for the reap
+timeout, we forget it, so that the table doesn't grow with every member that
+ever left.
+
+Anyone who can reach a member's address could send it a table, so with a
+secret key the members sign their messages with an HMAC and drop those that
+aren't signed with the same key. A replayed message can't do any harm, since
+we only ever take states newer than the ones we have.
+
+We don't use Serf itself, to keep the module free of its dependency tree
+(memberlist, with its msgpack codec and its DNS and metrics libraries), when
+all we need of it is what the Handler interface exposes: joins, leaves and
+failures, with each member's tags. Serf does more, like detecting failures
+through indirect probes and merging split clusters with a push-pull sync, and
+the agent only sees a Handler, so swapping Serf in later changes nothing else.
+*/
+type Membership struct {
+	Config
+	handler Handler
+	conn    *net.UDPConn
+	logger  *zap.Logger
+
+	mu      sync.Mutex
+	local   *member
+	members map[string]*member
+	events  []event
+	stopped bool
+	// blocked holds the addresses we drop messages from, which the tests
+	// use to split the cluster as a network partition would
+	blocked map[string]bool
+
+	notify   chan struct{}
+	acks     chan struct{}
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+/*
+Config configures a member. NodeName identifies the member in the cluster
+and must be unique; it defaults to the host's name. BindAddr is the address
+the member gossips on, which the other members reach it on too, so it should
+name a host rather than listen on every interface; if its port is 0 we pick a
+free one and set BindAddr to the address we bound. RPCAddr is the address the
+server serves its RPCs on, which we share with the other members as a tag so
+their handlers know where to reach it. Tags are any other tags to share.
+StartJoinAddrs are the gossip addresses of members already in the cluster to
+join through; a new cluster's first member has none.
+*/
+type Config struct {
+	NodeName       string
+	BindAddr       string
+	RPCAddr        string
+	Tags           map[string]string
+	StartJoinAddrs []string
+	// GossipInterval is how often the member gossips and FailureTimeout
+	// how long another member's heartbeat may stand still before we take
+	// it for failed. ReapTimeout is how long we keep a member that left or
+	// failed in our table before we forget it; a failed member that comes
+	// back within it rejoins. It must be well above FailureTimeout: until
+	// every member has taken a member for failed, those that haven't yet
+	// gossip it as alive, and a member that had already forgotten it would
+	// take it back in, so we raise it to twice FailureTimeout if it's any
+	// lower. They default to 200ms, 5s and 24h.
+	GossipInterval time.Duration
+	FailureTimeout time.Duration
+	ReapTimeout    time.Duration
+	// SecretKey is the key the members sign their messages with, which
+	// every member of the cluster must share. Nil sends the messages
+	// unsigned and takes any message, which only suits a trusted network.
+	SecretKey []byte
+	// Logger logs the membership changes. Nil logs nothing.
+	Logger *zap.Logger
+}
+
+const (
+	defaultGossipInterval = 200 * time.Millisecond
+	defaultFailureTimeout = 5 * time.Second
+	defaultReapTimeout    = 24 * time.Hour
+	// gossipFanout is how many live members we gossip with each interval.
+	gossipFanout = 3
+	// maxMessageSize bounds the messages we send, which UDP limits to just
+	// under 64KiB; we send a larger table in several messages.
+	maxMessageSize = 63 * 1024
+)
+
+/*
+rpcAddrTag is the tag members share their RPC address in.
+*/
+const rpcAddrTag = "rpc_addr"
+
+/*
+Handler is what Membership calls when another member joins the cluster, with
+its name and RPC address, and when it leaves or fails.
+*/
+type Handler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+/*
+Member is a member of the cluster as Members() reports it.
+*/
+type Member struct {
+	Name   string
+	Addr   string
+	Tags   map[string]string
+	Status MemberStatus
+}
+
+type MemberStatus int
+
+const (
+	StatusAlive MemberStatus = iota
+	StatusLeft
+	StatusFailed
+)
+
+func (s MemberStatus) String() string {
+	switch s {
+	case StatusAlive:
+		return "alive"
+	case StatusLeft:
+		return "left"
+	case StatusFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("MemberStatus(%d)", int(s))
+}
+
+/*
+memberState is a member's entry in the tables the members send each other.
+Incarnation is when the member started, so that a member that restarts under
+the same name is newer than it was before, whatever its old heartbeat.
+*/
+type memberState struct {
+	Name        string            `json:"name"`
+	Addr        string            `json:"addr"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Incarnation int64             `json:"incarnation"`
+	Heartbeat   uint64            `json:"heartbeat"`
+	Left        bool              `json:"left,omitempty"`
+}
+
+func (s memberState) newerThan(o memberState) bool {
+	if s.Incarnation != o.Incarnation {
+		return s.Incarnation > o.Incarnation
+	}
+	return s.Heartbeat > o.Heartbeat
+}
+
+/*
+member is a member's entry in our own table: its newest state we know of,
+its status as we see it, and when its state or status last changed.
+*/
+type member struct {
+	state   memberState
+	status  MemberStatus
+	updated time.Time
+}
+
+/*
+message is what members send each other: a table, and whether it answers
+another member's. A table too large for one message is split over several,
+and Rest marks all but the first, so that we answer a table only once.
+*/
+type message struct {
+	Ack     bool          `json:"ack,omitempty"`
+	Rest    bool          `json:"rest,omitempty"`
+	Members []memberState `json:"members"`
+}
+
+/*
+event is a change in another member's status for the handler to hear of.
+*/
+type event struct {
+	status MemberStatus
+	state  memberState
+}
+
+/*
+New(handler Handler, config Config) starts a member and, if the config gives
+addresses to join through, joins it to their cluster.
+*/
+func New(handler Handler, config Config) (*Membership, error) {
+	m := &Membership{
+		Config:   config,
+		handler:  handler,
+		logger:   config.Logger,
+		members:  make(map[string]*member),
+		notify:   make(chan struct{}, 1),
+		acks:     make(chan struct{}, 1),
+		shutdown: make(chan struct{}),
+	}
+	if m.logger == nil {
+		m.logger = zap.NewNop()
+	}
+	m.logger = m.logger.Named("membership")
+	if m.GossipInterval == 0 {
+		m.GossipInterval = defaultGossipInterval
+	}
+	if m.FailureTimeout == 0 {
+		m.FailureTimeout = defaultFailureTimeout
+	}
+	if m.ReapTimeout == 0 {
+		m.ReapTimeout = defaultReapTimeout
+	}
+	if m.ReapTimeout < 2*m.FailureTimeout {
+		m.ReapTimeout = 2 * m.FailureTimeout
+	}
+	if m.NodeName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		m.NodeName = hostname
+	}
+	if err := m.setup(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+/*
+setup() binds the member's address, adds the member to its own table, starts
+gossiping and handling events, and joins the cluster.
+*/
+func (m *Membership) setup() error {
+	addr, err := net.ResolveUDPAddr("udp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+	if m.conn, err = net.ListenUDP("udp", addr); err != nil {
+		return err
+	}
+	m.BindAddr = m.conn.LocalAddr().String()
+	tags := make(map[string]string)
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	tags[rpcAddrTag] = m.RPCAddr
+	m.local = &member{
+		state: memberState{
+			Name:        m.NodeName,
+			Addr:        m.BindAddr,
+			Tags:        tags,
+			Incarnation: time.Now().UnixNano(),
+		},
+		status: StatusAlive,
+	}
+	m.members[m.NodeName] = m.local
+	m.wg.Add(3)
+	go m.listen()
+	go m.gossip()
+	go m.eventHandler()
+	if len(m.StartJoinAddrs) > 0 {
+		if err = m.join(m.StartJoinAddrs); err != nil {
+			m.Shutdown()
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+join(addrs) sends our table to the members at the given addresses and waits
+for one of them to answer. Since UDP may drop the messages, we send them again
+each gossip interval, and give up once the failure timeout has gone by.
+*/
+func (m *Membership) join(addrs []string) error {
+	var peers []*net.UDPAddr
+	for _, addr := range addrs {
+		peer, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, peer)
+	}
+	timeout := time.NewTimer(m.FailureTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(m.GossipInterval)
+	defer ticker.Stop()
+	for {
+		m.mu.Lock()
+		msgs := m.message(false)
+		m.mu.Unlock()
+		for _, peer := range peers {
+			m.send(peer, msgs)
+		}
+		select {
+		case <-m.acks:
+			return nil
+		case <-ticker.C:
+		case <-timeout.C:
+			return fmt.Errorf("no member answered at %v", addrs)
+		}
+	}
+}
+
+/*
+listen() merges the tables other members send us and answers them with ours,
+until the member shuts down and closes its connection.
+*/
+func (m *Membership) listen() {
+	defer m.wg.Done()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			m.logger.Error("failed to read message", zap.Error(err))
+			continue
+		}
+		p, ok := m.verify(buf[:n])
+		if !ok {
+			m.logger.Warn(
+				"dropped message with a bad signature",
+				zap.String("addr", addr.String()),
+			)
+			continue
+		}
+		var msg message
+		if err = json.Unmarshal(p, &msg); err != nil {
+			m.logger.Error(
+				"failed to decode message",
+				zap.Error(err),
+				zap.String("addr", addr.String()),
+			)
+			continue
+		}
+		m.mu.Lock()
+		if m.blocked[addr.String()] {
+			m.mu.Unlock()
+			continue
+		}
+		m.merge(msg.Members)
+		var msgs [][]byte
+		if !msg.Ack && !msg.Rest {
+			msgs = m.message(true)
+		}
+		m.mu.Unlock()
+		if msg.Ack {
+			select {
+			case m.acks <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		m.send(addr, msgs)
+	}
+}
+
+/*
+merge(states) merges another member's table into ours, taking each member's
+state if it's newer than ours, and records the members that joined or left as
+a result. We skip our own entry: we're the only one who knows our state. We
+also skip a member we hadn't heard of that has already left: there's nothing
+to tell the handler, and a member we reaped would otherwise come back each
+time a member that hasn't reaped it yet gossips with us. The caller must hold
+the lock.
+*/
+func (m *Membership) merge(states []memberState) {
+	now := time.Now()
+	for _, s := range states {
+		if s.Name == m.NodeName {
+			continue
+		}
+		e, ok := m.members[s.Name]
+		if !ok {
+			if s.Left {
+				continue
+			}
+			e = &member{state: s, status: StatusAlive, updated: now}
+			m.members[s.Name] = e
+			m.emit(e)
+			continue
+		}
+		if !s.newerThan(e.state) {
+			continue
+		}
+		e.state, e.updated = s, now
+		switch {
+		case s.Left && e.status == StatusAlive:
+			e.status = StatusLeft
+			m.emit(e)
+		case s.Left:
+			// we already took it for failed, so it's already gone
+			e.status = StatusLeft
+		case e.status != StatusAlive:
+			e.status = StatusAlive
+			m.emit(e)
+		}
+	}
+}
+
+/*
+gossip() sends our table to the members tick() picks each gossip interval,
+until the member shuts down.
+*/
+func (m *Membership) gossip() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.GossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.shutdown:
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		peers := m.tick()
+		msgs := m.message(false)
+		m.mu.Unlock()
+		for _, peer := range peers {
+			m.send(peer, msgs)
+		}
+	}
+}
+
+/*
+tick() bumps our heartbeat, takes the members whose heartbeat has stood still
+for the failure timeout for failed, forgets the members that have been gone
+for the reap timeout, and picks whom to gossip with: a few of the live
+members, and one of the failed ones, so that members a network partition split
+apart find each other again once it heals. The caller must hold the lock.
+*/
+func (m *Membership) tick() []*net.UDPAddr {
+	m.local.state.Heartbeat++
+	now := time.Now()
+	var alive, failed []*member
+	for _, e := range m.members {
+		if e == m.local {
+			continue
+		}
+		if e.status == StatusAlive && now.Sub(e.updated) > m.FailureTimeout {
+			e.status, e.updated = StatusFailed, now
+			m.emit(e)
+		}
+		if e.status != StatusAlive && now.Sub(e.updated) > m.ReapTimeout {
+			m.logger.Debug("member reaped", zap.String("name", e.state.Name))
+			delete(m.members, e.state.Name)
+			continue
+		}
+		switch e.status {
+		case StatusAlive:
+			alive = append(alive, e)
+		case StatusFailed:
+			failed = append(failed, e)
+		}
+	}
+	rand.Shuffle(len(alive), func(i, j int) {
+		alive[i], alive[j] = alive[j], alive[i]
+	})
+	if len(alive) > gossipFanout {
+		alive = alive[:gossipFanout]
+	}
+	if len(failed) > 0 {
+		alive = append(alive, failed[rand.Intn(len(failed))])
+	}
+	return m.addrs(alive)
+}
+
+/*
+addrs(members) resolves the members' gossip addresses, skipping any that fail
+to resolve.
+*/
+func (m *Membership) addrs(members []*member) []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	for _, e := range members {
+		addr, err := net.ResolveUDPAddr("udp", e.state.Addr)
+		if err != nil {
+			m.logError(err, "failed to resolve address", e.state)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+/*
+message(ack) encodes our table to send, in as many messages as it takes. We
+leave out the members we took for failed, since that's only our view of them,
+and put our own state first, so that it goes in the first message. The caller
+must hold the lock.
+*/
+func (m *Membership) message(ack bool) [][]byte {
+	msg := message{Ack: ack, Members: []memberState{m.local.state}}
+	for _, e := range m.members {
+		if e == m.local || e.status == StatusFailed {
+			continue
+		}
+		msg.Members = append(msg.Members, e.state)
+	}
+	return m.encode(msg)
+}
+
+/*
+encode(msg message) encodes and signs the message, splitting its table in
+halves until each half fits in a message. A member whose state alone doesn't
+fit, say because of its tags, can't be sent at all, so we leave it out and
+warn.
+*/
+func (m *Membership) encode(msg message) [][]byte {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		// a table of strings and numbers always marshals
+		panic(err)
+	}
+	b = m.sign(b)
+	if len(b) <= maxMessageSize {
+		return [][]byte{b}
+	}
+	if len(msg.Members) == 1 {
+		m.logger.Warn(
+			"member state too large to send",
+			zap.String("name", msg.Members[0].Name),
+			zap.Int("size", len(b)),
+		)
+		return nil
+	}
+	half := len(msg.Members) / 2
+	first, rest := msg, msg
+	first.Members = msg.Members[:half]
+	rest.Members, rest.Rest = msg.Members[half:], true
+	return append(m.encode(first), m.encode(rest)...)
+}
+
+/*
+sign(p []byte) appends the HMAC-SHA256 of the encoded message under our secret
+key, if we have one, and verify(b []byte) checks it and returns the message
+without it. We compare the HMACs in constant time, so that a forger can't
+learn one byte by byte from how long we take to reject it.
+*/
+func (m *Membership) sign(p []byte) []byte {
+	if m.SecretKey == nil {
+		return p
+	}
+	mac := hmac.New(sha256.New, m.SecretKey)
+	mac.Write(p)
+	return mac.Sum(p)
+}
+
+func (m *Membership) verify(b []byte) ([]byte, bool) {
+	if m.SecretKey == nil {
+		return b, true
+	}
+	if len(b) < sha256.Size {
+		return nil, false
+	}
+	p, sum := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	mac := hmac.New(sha256.New, m.SecretKey)
+	mac.Write(p)
+	return p, hmac.Equal(sum, mac.Sum(nil))
+}
+
+func (m *Membership) send(addr *net.UDPAddr, msgs [][]byte) {
+	for _, b := range msgs {
+		if _, err := m.conn.WriteToUDP(b, addr); err != nil {
+			m.logger.Warn(
+				"failed to send message",
+				zap.Error(err),
+				zap.String("addr", addr.String()),
+				zap.Int("size", len(b)),
+			)
+		}
+	}
+}
+
+/*
+emit(e) queues the member's new status for the event handler. We call the
+handler from its own goroutine, outside the lock, so that the handler can
+call Members(), and in the order the changes happened. The caller must hold
+the lock.
+*/
+func (m *Membership) emit(e *member) {
+	m.logger.Info(
+		"member "+e.status.String(),
+		zap.String("name", e.state.Name),
+		zap.String(rpcAddrTag, e.state.Tags[rpcAddrTag]),
+	)
+	m.events = append(m.events, event{status: e.status, state: e.state})
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+/*
+eventHandler() calls the handler for each member that joins, leaves or fails,
+until the member shuts down.
+*/
+func (m *Membership) eventHandler() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.shutdown:
+			return
+		case <-m.notify:
+		}
+		m.mu.Lock()
+		events := m.events
+		m.events = nil
+		m.mu.Unlock()
+		for _, e := range events {
+			if e.status == StatusAlive {
+				m.handleJoin(e.state)
+			} else {
+				m.handleLeave(e.state)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(s memberState) {
+	if err := m.handler.Join(s.Name, s.Tags[rpcAddrTag]); err != nil {
+		m.logError(err, "failed to join", s)
+	}
+}
+
+func (m *Membership) handleLeave(s memberState) {
+	if err := m.handler.Leave(s.Name); err != nil {
+		m.logError(err, "failed to leave", s)
+	}
+}
+
+/*
+Members() returns the cluster's members as this member knows them, sorted by
+name, including itself and the ones that left or failed, with their status,
+until they're reaped.
+*/
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := make([]Member, 0, len(m.members))
+	for _, e := range m.members {
+		members = append(members, Member{
+			Name:   e.state.Name,
+			Addr:   e.state.Addr,
+			Tags:   e.state.Tags,
+			Status: e.status,
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members
+}
+
+/*
+LookupRPCAddr(name string) returns the RPC address the member with the given
+name shares in its tags, if it's alive, so that a server can tell clients
+where to reach the others; it can be a log.Config's Raft.RPCAddr.
+*/
+func (m *Membership) LookupRPCAddr(name string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.members[name]
+	if !ok || e.status != StatusAlive {
+		return "", false
+	}
+	addr, ok := e.state.Tags[rpcAddrTag]
+	return addr, ok
+}
+
+/*
+Leave() tells the other members this one is leaving the cluster, so they see
+it leave rather than fail, and then shuts it down. We send our table marked as
+left straight to every live member rather than waiting for it to spread.
+*/
+func (m *Membership) Leave() error {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return errors.New("membership shut down")
+	}
+	m.local.state.Left = true
+	m.local.state.Heartbeat++
+	m.local.status = StatusLeft
+	var alive []*member
+	for _, e := range m.members {
+		if e != m.local && e.status == StatusAlive {
+			alive = append(alive, e)
+		}
+	}
+	peers := m.addrs(alive)
+	msgs := m.message(false)
+	m.mu.Unlock()
+	for _, peer := range peers {
+		m.send(peer, msgs)
+	}
+	return m.Shutdown()
+}
+
+/*
+Shutdown() stops the member without telling the others, so they take it for
+failed once its heartbeat stands still for long enough. It's safe to call
+more than once.
+*/
+func (m *Membership) Shutdown() error {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return nil
+	}
+	m.stopped = true
+	m.mu.Unlock()
+	close(m.shutdown)
+	err := m.conn.Close()
+	m.wg.Wait()
+	return err
+}
+
+func (m *Membership) logError(err error, msg string, s memberState) {
+	m.logger.Error(
+		msg,
+		zap.Error(err),
+		zap.String("name", s.Name),
+		zap.String(rpcAddrTag, s.Tags[rpcAddrTag]),
+	)
+}
@@ -0,0 +1,395 @@
+package discovery
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+/*
+TestMembership(*testing.T) starts a cluster of three members on loopback and
+checks that the first one's handler sees the others join, one leave, one fail
+and come back under the same name, and that every member agrees on who's in
+the cluster.
+*/
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	require.Eventually(t, func() bool {
+		for _, member := range m {
+			if !allStatus(member.Members(), 3, StatusAlive) {
+				return false
+			}
+		}
+		return len(handler.joins) == 2 && len(handler.leaves) == 0
+	}, 3*time.Second, 50*time.Millisecond)
+	for i := 1; i <= 2; i++ {
+		require.Equal(t, map[string]string{
+			fmt.Sprintf("%d", i): fmt.Sprintf("rpc-%d", i),
+		}, <-handler.joins)
+		addr, ok := m[0].LookupRPCAddr(fmt.Sprintf("%d", i))
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprintf("rpc-%d", i), addr)
+	}
+
+	require.NoError(t, m[2].Leave())
+	require.Eventually(t, func() bool {
+		members := m[0].Members()
+		return len(members) == 3 &&
+			members[2].Status == StatusLeft &&
+			len(handler.leaves) == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, "2", <-handler.leaves)
+	_, ok := m[0].LookupRPCAddr("2")
+	require.False(t, ok)
+	// the member that's left learns of the one that left through gossip
+	require.Eventually(t, func() bool {
+		return m[1].Members()[2].Status == StatusLeft
+	}, 3*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, m[1].Shutdown())
+	require.Eventually(t, func() bool {
+		return m[0].Members()[1].Status == StatusFailed &&
+			len(handler.leaves) == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, "1", <-handler.leaves)
+
+	// a member that restarts under a failed member's name rejoins
+	m, _ = setupMember(t, m[:1])
+	require.Eventually(t, func() bool {
+		return m[0].Members()[1].Status == StatusAlive &&
+			len(handler.joins) == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, map[string]string{"1": "rpc-1"}, <-handler.joins)
+	require.Len(t, handler.leaves, 0)
+}
+
+/*
+TestJoinFailure(*testing.T) checks that New fails when no member answers at
+the addresses it's given to join through.
+*/
+func TestJoinFailure(t *testing.T) {
+	m, _ := setupMember(t, nil)
+	addr := m[0].BindAddr
+	require.NoError(t, m[0].Shutdown())
+
+	_, err := New(&handler{}, Config{
+		NodeName:       "1",
+		BindAddr:       "127.0.0.1:0",
+		StartJoinAddrs: []string{addr},
+		GossipInterval: 50 * time.Millisecond,
+		FailureTimeout: 500 * time.Millisecond,
+	})
+	require.Error(t, err)
+}
+
+/*
+TestLargeMembership(*testing.T) feeds a member a table too large for one
+message, and checks that a member joining through it learns the whole table,
+and that both forget the members once they've left or failed for the reap
+timeout.
+*/
+func TestLargeMembership(t *testing.T) {
+	// the handlers don't record the thousands of changes
+	newMember := func(name string, join ...string) *Membership {
+		m, err := New(&handler{}, Config{
+			NodeName:       name,
+			BindAddr:       "127.0.0.1:0",
+			StartJoinAddrs: join,
+			GossipInterval: 50 * time.Millisecond,
+			FailureTimeout: time.Second,
+			ReapTimeout:    2 * time.Second,
+			SecretKey:      secretKey,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Shutdown() })
+		return m
+	}
+	m := []*Membership{newMember("0")}
+	const n = 1000
+	var fakes []memberState
+	for i := 0; i < n; i++ {
+		fakes = append(fakes, memberState{
+			Name:        fmt.Sprintf("fake-%d", i),
+			Addr:        "127.0.0.1:1",
+			Tags:        map[string]string{rpcAddrTag: strings.Repeat("x", 100)},
+			Incarnation: 1,
+		})
+	}
+	inject := func(states []memberState) {
+		conn, err := net.Dial("udp", m[0].BindAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+		msgs := m[0].encode(message{Ack: true, Members: states})
+		require.Greater(t, len(msgs), 1)
+		for _, b := range msgs {
+			require.LessOrEqual(t, len(b), maxMessageSize)
+			_, err = conn.Write(b)
+			require.NoError(t, err)
+		}
+	}
+	// the socket's buffer may not hold every message at once, so we send
+	// the table again until it's all in
+	require.Eventually(t, func() bool {
+		inject(fakes)
+		return len(m[0].Members()) == n+1
+	}, 3*time.Second, 100*time.Millisecond)
+
+	m = append(m, newMember("1", m[0].BindAddr))
+	require.Eventually(t, func() bool {
+		return len(m[1].Members()) == n+2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// half the fake members leave, and the other half, and any whose
+	// leaving got lost, fail
+	for i := range fakes[:n/2] {
+		fakes[i].Left = true
+		fakes[i].Heartbeat++
+	}
+	inject(fakes[:n/2])
+	require.Eventually(t, func() bool {
+		return allStatus(m[0].Members(), 2, StatusAlive) &&
+			allStatus(m[1].Members(), 2, StatusAlive)
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+/*
+TestAuthentication(*testing.T) checks that a member drops the messages that
+aren't signed with the cluster's key, so that neither a member with another
+key nor anyone sending unsigned messages can join.
+*/
+func TestAuthentication(t *testing.T) {
+	m, _ := setupMember(t, nil)
+
+	_, err := New(&handler{}, Config{
+		NodeName:       "1",
+		BindAddr:       "127.0.0.1:0",
+		StartJoinAddrs: []string{m[0].BindAddr},
+		GossipInterval: 50 * time.Millisecond,
+		FailureTimeout: 500 * time.Millisecond,
+		SecretKey:      []byte("another key"),
+	})
+	require.Error(t, err)
+
+	conn, err := net.Dial("udp", m[0].BindAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	b, err := json.Marshal(message{Members: []memberState{{
+		Name:        "intruder",
+		Addr:        conn.LocalAddr().String(),
+		Incarnation: 1,
+	}}})
+	require.NoError(t, err)
+	_, err = conn.Write(b)
+	require.NoError(t, err)
+	// a member answers a table it takes, so no answer means it dropped ours
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+	_, err = conn.Read(make([]byte, maxMessageSize))
+	require.Error(t, err)
+	require.Len(t, m[0].Members(), 1)
+}
+
+/*
+TestPartition(*testing.T) splits a cluster of three members so that the first
+can't reach the other two, and checks that each side takes the other for
+failed, and that once the partition heals they find each other again through
+the failed members they keep gossiping with, and the first one's handler sees
+the others join again.
+*/
+func TestPartition(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+	require.Eventually(t, func() bool {
+		for _, member := range m {
+			if !allStatus(member.Members(), 3, StatusAlive) {
+				return false
+			}
+		}
+		return len(handler.joins) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	<-handler.joins
+	<-handler.joins
+
+	partition := func(healed bool) {
+		block := func(member *Membership, others ...*Membership) {
+			member.mu.Lock()
+			defer member.mu.Unlock()
+			member.blocked = make(map[string]bool)
+			for _, o := range others {
+				member.blocked[o.BindAddr] = !healed
+			}
+		}
+		block(m[0], m[1:]...)
+		block(m[1], m[0])
+		block(m[2], m[0])
+	}
+	partition(false)
+	require.Eventually(t, func() bool {
+		members := m[0].Members()
+		return members[1].Status == StatusFailed &&
+			members[2].Status == StatusFailed &&
+			m[1].Members()[0].Status == StatusFailed &&
+			m[2].Members()[0].Status == StatusFailed &&
+			len(handler.leaves) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	// the side without the first member still sees its own members
+	require.Equal(t, StatusAlive, m[1].Members()[2].Status)
+	<-handler.leaves
+	<-handler.leaves
+
+	partition(true)
+	require.Eventually(t, func() bool {
+		for _, member := range m {
+			if !allStatus(member.Members(), 3, StatusAlive) {
+				return false
+			}
+		}
+		return len(handler.joins) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Len(t, handler.leaves, 0)
+}
+
+/*
+TestRejoin(*testing.T) checks that a member that left can join the cluster
+again under the same name, and that the other members' handlers see it join
+again.
+*/
+func TestRejoin(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	require.Equal(t, map[string]string{"1": "rpc-1"}, <-handler.joins)
+
+	require.NoError(t, m[1].Leave())
+	require.Equal(t, "1", <-handler.leaves)
+	require.Equal(t, StatusLeft, m[0].Members()[1].Status)
+
+	m, _ = setupMember(t, m[:1])
+	require.Equal(t, map[string]string{"1": "rpc-1"}, <-handler.joins)
+	require.Eventually(t, func() bool {
+		return allStatus(m[0].Members(), 2, StatusAlive) &&
+			allStatus(m[1].Members(), 2, StatusAlive)
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Len(t, handler.leaves, 0)
+}
+
+/*
+TestForgedMessages(*testing.T) sends a member messages saying that another
+member left, signed with another key, unsigned, and with the signature of
+another message, and checks that it drops them all, and then that it takes
+the same message signed with the cluster's key, so that dropping the others
+is what kept the member in.
+*/
+func TestForgedMessages(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	require.Equal(t, map[string]string{"1": "rpc-1"}, <-handler.joins)
+
+	m[1].mu.Lock()
+	state := m[1].local.state
+	m[1].mu.Unlock()
+	state.Left = true
+	state.Heartbeat += 1000
+	forged := message{Ack: true, Members: []memberState{state}}
+	p, err := json.Marshal(forged)
+	require.NoError(t, err)
+	other := &Membership{Config: Config{SecretKey: []byte("another key")}}
+	genuine := m[0].sign([]byte(`{"ack":true,"members":[]}`))
+	stolen := genuine[len(genuine)-sha256.Size:]
+
+	conn, err := net.Dial("udp", m[0].BindAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, b := range [][]byte{
+		other.encode(forged)[0],
+		p,
+		append(p, stolen...),
+	} {
+		_, err = conn.Write(b)
+		require.NoError(t, err)
+	}
+	require.Never(t, func() bool {
+		return m[0].Members()[1].Status != StatusAlive ||
+			len(handler.leaves) > 0
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	_, err = conn.Write(m[0].encode(forged)[0])
+	require.NoError(t, err)
+	require.Equal(t, "1", <-handler.leaves)
+	require.Equal(t, StatusLeft, m[0].Members()[1].Status)
+}
+
+/*
+setupMember(t, members) starts a member named after its index in members,
+joining the cluster through the first member if there is one, and returns
+members with it added. Only the first member's handler records the changes
+it hears of.
+*/
+func setupMember(t *testing.T, members []*Membership) (
+	[]*Membership, *handler,
+) {
+	id := len(members)
+	c := Config{
+		NodeName:       fmt.Sprintf("%d", id),
+		BindAddr:       "127.0.0.1:0",
+		RPCAddr:        fmt.Sprintf("rpc-%d", id),
+		GossipInterval: 50 * time.Millisecond,
+		FailureTimeout: 500 * time.Millisecond,
+		SecretKey:      secretKey,
+	}
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = make(chan map[string]string, 3)
+		h.leaves = make(chan string, 3)
+	} else {
+		c.StartJoinAddrs = []string{members[0].BindAddr}
+	}
+	m, err := New(h, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Shutdown() })
+	return append(members, m), h
+}
+
+/*
+secretKey is the key the tests' members sign their messages with.
+*/
+var secretKey = []byte("secret")
+
+func allStatus(members []Member, n int, status MemberStatus) bool {
+	if len(members) != n {
+		return false
+	}
+	for _, member := range members {
+		if member.Status != status {
+			return false
+		}
+	}
+	return true
+}
+
+type handler struct {
+	joins  chan map[string]string
+	leaves chan string
+}
+
+func (h *handler) Join(name, addr string) error {
+	if h.joins != nil {
+		h.joins <- map[string]string{name: addr}
+	}
+	return nil
+}
+
+func (h *handler) Leave(name string) error {
+	if h.leaves != nil {
+		h.leaves <- name
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package loadbalance
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+func init() {
+	balancer.Register(
+		base.NewBalancerBuilder(Name, pickerBuilder{}, base.Config{}),
+	)
+}
+
+/*
+Picker picks the server each RPC goes to: the produce RPCs go to the leader,
+since only the leader appends records, and every other RPC, the consume RPCs
+among them, goes to the followers in turn, to spread the reads over the
+servers that don't take the writes. A follower may not have replicated the
+latest records yet, so a consumer may have to wait a little longer for them.
+If the cluster has no followers, the leader takes the reads too.
+*/
+type Picker struct {
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	current   uint64
+}
+
+/*
+pickerBuilder builds a new Picker with the servers the balancer is connected
+to whenever they change, as the resolver tells it.
+*/
+type pickerBuilder struct{}
+
+var _ base.PickerBuilder = pickerBuilder{}
+
+func (pickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{}
+	for sc, scInfo := range buildInfo.ReadySCs {
+		if isLeader(scInfo.Address) {
+			p.leader = sc
+		} else {
+			p.followers = append(p.followers, sc)
+		}
+	}
+	return p
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+/*
+Pick(info balancer.PickInfo) picks the server for the RPC. If it hasn't a
+server to pick, like when no server we're connected to is the leader, it
+returns balancer.ErrNoSubConnAvailable, which has gRPC hold the RPC until the
+balancer builds a new Picker.
+*/
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var result balancer.PickResult
+	if strings.HasPrefix(info.FullMethodName, "/log.v1.Log/Produce") ||
+		len(p.followers) == 0 {
+		result.SubConn = p.leader
+	} else {
+		result.SubConn = p.nextFollower()
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, 1)
+	return p.followers[cur%uint64(len(p.followers))]
+}
@@ -0,0 +1,163 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+)
+
+/*
+TestPicker(*testing.T) checks that the picker sends the produce RPCs to the
+leader and the others to the followers in turn, and holds the RPCs it has no
+server for.
+*/
+func TestPicker(t *testing.T) {
+	leader := &subConn{}
+	followers := []*subConn{{}, {}}
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			leader: {Address: address(true)},
+		},
+	}
+	for _, sc := range followers {
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: address(false)}
+	}
+	picker := pickerBuilder{}.Build(buildInfo)
+
+	for _, method := range []string{"Produce", "ProduceBatch", "ProduceStream"} {
+		res, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: "/log.v1.Log/" + method,
+		})
+		require.NoError(t, err)
+		require.Equal(t, leader, res.SubConn)
+	}
+	picked := map[balancer.SubConn]int{}
+	for i := 0; i < 4; i++ {
+		res, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: "/log.v1.Log/Consume",
+		})
+		require.NoError(t, err)
+		picked[res.SubConn]++
+	}
+	require.Equal(t, map[balancer.SubConn]int{
+		followers[0]: 2,
+		followers[1]: 2,
+	}, picked)
+
+	// no leader, and a lone leader
+	picker = pickerBuilder{}.Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			followers[0]: {Address: address(false)},
+		},
+	})
+	_, err := picker.Pick(balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Produce",
+	})
+	require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+	picker = pickerBuilder{}.Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			leader: {Address: address(true)},
+		},
+	})
+	res, err := picker.Pick(balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Consume",
+	})
+	require.NoError(t, err)
+	require.Equal(t, leader, res.SubConn)
+}
+
+/*
+TestLoadBalancing(*testing.T) dials a cluster of three servers through one of
+its followers with a proglog:// target, and checks that the records produced
+go to the leader and the consume requests to the followers.
+*/
+func TestLoadBalancing(t *testing.T) {
+	nodes := setupCluster(t, 3)
+	cc, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", Name, nodes[1].addr),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(&Builder{PollInterval: 100 * time.Millisecond}),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+	ctx := context.Background()
+
+	values := []string{"first", "second", "third"}
+	for _, value := range values {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+	for i, value := range append(values, values...) {
+		off := uint64(i % len(values))
+		// the follower may not have replicated the record yet
+		require.Eventually(t, func() bool {
+			res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: off})
+			return err == nil && string(res.Record.Value) == value
+		}, 3*time.Second, 10*time.Millisecond)
+	}
+
+	require.Equal(t, 3.0, requests(t, nodes[0].metrics, "Produce"))
+	require.Equal(t, 0.0, requests(t, nodes[0].metrics, "Consume"))
+	for _, node := range nodes[1:] {
+		require.Equal(t, 0.0, requests(t, node.metrics, "Produce"))
+		require.Greater(t, requests(t, node.metrics, "Consume"), 0.0)
+	}
+}
+
+/*
+requests(t, reg, method) returns how many requests of the Log service's method
+the server with the registry took.
+*/
+func requests(t *testing.T, reg *prometheus.Registry, method string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	var n float64
+	for _, family := range families {
+		if family.GetName() != "proglog_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "method" &&
+					label.GetValue() == "/log.v1.Log/"+method {
+					n += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return n
+}
+
+func address(leader bool) resolver.Address {
+	return resolver.Address{
+		Attributes: attributes.New(isLeaderKey{}, leader),
+	}
+}
+
+/*
+subConn is a balancer.SubConn the picker can pick, that connects to nothing.
+*/
+type subConn struct {
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
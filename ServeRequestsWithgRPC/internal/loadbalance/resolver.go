@@ -0,0 +1,200 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+/*
+Name is the scheme of the targets our resolver resolves, as in
+"proglog:///127.0.0.1:8400", and the name of our balancer, which the resolver
+has gRPC use for them.
+*/
+const Name = "proglog"
+
+/*
+defaultPollInterval is how often the resolver we register lists the servers
+again, to find the servers that joined or left and a new leader.
+*/
+const defaultPollInterval = 10 * time.Second
+
+func init() {
+	resolver.Register(&Builder{PollInterval: defaultPollInterval})
+}
+
+/*
+Builder builds the resolvers for proglog:// targets. A client that knows one
+server dials "proglog:///<its address>", and the resolver asks that server for
+the cluster's servers with GetServers, so the client connects to all of them,
+and our balancer sends each RPC to the right one. The resolver connects to the
+server with the client's credentials.
+
+Importing the package registers a Builder that polls every ten seconds; dial
+with grpc.WithResolvers to use another.
+*/
+type Builder struct {
+	// PollInterval is how often the resolver lists the servers again.
+	// Zero only lists them when gRPC asks, like when a connection fails.
+	PollInterval time.Duration
+	// Logger logs the resolver's failures to list the servers. Nil logs
+	// nothing.
+	Logger *zap.Logger
+}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+/*
+Build(target, cc, opts) dials the target's server and lists the servers in
+the cluster for the client connection, and then again every poll interval
+until the resolver is closed.
+*/
+func (b *Builder) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	if opts.DialCreds != nil {
+		dialOpts = []grpc.DialOption{
+			grpc.WithTransportCredentials(opts.DialCreds),
+		}
+	}
+	conn, err := grpc.Dial(target.Endpoint, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	logger := b.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	r := &Resolver{
+		clientConn:   cc,
+		resolverConn: conn,
+		logger:       logger.Named("resolver"),
+		serviceConfig: cc.ParseServiceConfig(
+			fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+		),
+		close: make(chan struct{}),
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	if b.PollInterval > 0 {
+		r.wg.Add(1)
+		go r.poll(b.PollInterval)
+	}
+	return r, nil
+}
+
+func (b *Builder) Scheme() string {
+	return Name
+}
+
+/*
+Resolver resolves a proglog:// target to the cluster's servers, each
+address marked with whether the server is the leader for our picker.
+*/
+type Resolver struct {
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+
+	// mu serializes the resolutions, so that an older list of servers
+	// never replaces a newer one
+	mu    sync.Mutex
+	once  sync.Once
+	close chan struct{}
+	wg    sync.WaitGroup
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+/*
+resolveTimeout is how long we wait for a server to list the servers.
+*/
+const resolveTimeout = 5 * time.Second
+
+/*
+ResolveNow(resolver.ResolveNowOptions) lists the servers and updates the
+client connection with them. If listing them fails, the client connection
+keeps the servers it has.
+*/
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	client := api.NewLogClient(r.resolverConn)
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		addrs = append(addrs, resolver.Address{
+			Addr: server.RpcAddr,
+			Attributes: attributes.New(
+				isLeaderKey{},
+				server.IsLeader,
+			),
+		})
+	}
+	if err = r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Error("failed to update servers", zap.Error(err))
+	}
+}
+
+func (r *Resolver) poll(interval time.Duration) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+/*
+Close() stops polling and closes the connection to the server we list the
+servers with.
+*/
+func (r *Resolver) Close() {
+	r.once.Do(func() {
+		close(r.close)
+		r.wg.Wait()
+		if err := r.resolverConn.Close(); err != nil {
+			r.logger.Error("failed to close conn", zap.Error(err))
+		}
+	})
+}
+
+/*
+isLeaderKey is the key of the attribute that marks whether an address is the
+leader's.
+*/
+type isLeaderKey struct{}
+
+func isLeader(addr resolver.Address) bool {
+	leader, _ := addr.Attributes.Value(isLeaderKey{}).(bool)
+	return leader
+}
@@ -0,0 +1,175 @@
+package loadbalance
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SStoyanov22/proglog/internal/log"
+	"github.com/SStoyanov22/proglog/internal/mux"
+	"github.com/SStoyanov22/proglog/internal/server"
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+/*
+TestResolver(*testing.T) resolves a follower's address in a cluster of three
+servers, and checks that the resolver finds every server, marks the leader's
+address, and has the client connection use our balancer.
+*/
+func TestResolver(t *testing.T) {
+	nodes := setupCluster(t, 3)
+	conn := &clientConn{}
+	r, err := (&Builder{}).Build(
+		resolver.Target{Endpoint: nodes[1].addr},
+		conn,
+		resolver.BuildOptions{},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var want []resolver.Address
+	for i, node := range nodes {
+		want = append(want, resolver.Address{
+			Addr:       node.addr,
+			Attributes: attributes.New(isLeaderKey{}, i == 0),
+		})
+	}
+	require.ElementsMatch(t, want, conn.state.Addresses)
+	require.Equal(t, conn.serviceConfig, conn.state.ServiceConfig)
+	require.Equal(
+		t,
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+		conn.serviceConfigJSON,
+	)
+}
+
+/*
+clientConn is a resolver.ClientConn that records the last state the resolver
+gave it.
+*/
+type clientConn struct {
+	state             resolver.State
+	serviceConfig     *serviceconfig.ParseResult
+	serviceConfigJSON string
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.state = state
+	return nil
+}
+
+func (c *clientConn) ReportError(error) {}
+
+func (c *clientConn) NewAddress([]resolver.Address) {}
+
+func (c *clientConn) NewServiceConfig(string) {}
+
+func (c *clientConn) ParseServiceConfig(
+	config string,
+) *serviceconfig.ParseResult {
+	c.serviceConfigJSON = config
+	c.serviceConfig = &serviceconfig.ParseResult{}
+	return c.serviceConfig
+}
+
+type clusterNode struct {
+	addr    string
+	log     *log.DistributedLog
+	metrics *prometheus.Registry
+}
+
+/*
+setupCluster(t, n) runs a cluster of n servers on loopback, the first of them
+the leader. Each server serves Raft and gRPC on ports of their own, so the
+servers have to look up each other's RPC addresses rather than report the
+addresses Raft knows them by, and records its request metrics, so tests can
+tell which server took an RPC.
+*/
+func setupCluster(t *testing.T, n int) []*clusterNode {
+	t.Helper()
+	var nodes []*clusterNode
+	var mu sync.Mutex
+	rpcAddrs := make(map[string]string)
+	rpcAddr := func(id string) (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		addr, ok := rpcAddrs[id]
+		return addr, ok
+	}
+	for i := 0; i < n; i++ {
+		raftLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		m := mux.New(raftLn, log.RaftRPC)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		node := &clusterNode{
+			addr:    ln.Addr().String(),
+			metrics: prometheus.NewRegistry(),
+		}
+		mu.Lock()
+		rpcAddrs[fmt.Sprintf("%d", i)] = node.addr
+		mu.Unlock()
+
+		dataDir, err := ioutil.TempDir("", "loadbalance-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dataDir) })
+		c := log.Config{}
+		c.Raft.StreamLayer = log.NewStreamLayer(m.Peer(), nil, nil)
+		c.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		c.Raft.BindAddr = raftLn.Addr().String()
+		c.Raft.RPCAddr = rpcAddr
+		c.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		c.Raft.ElectionTimeout = 50 * time.Millisecond
+		c.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		c.Raft.CommitTimeout = 5 * time.Millisecond
+		c.Raft.LogOutput = io.Discard
+		c.Raft.Bootstrap = i == 0
+		node.log, err = log.NewDistributedLog(dataDir, c)
+		require.NoError(t, err)
+
+		gsrv, err := server.NewGRPCServer(&server.Config{
+			CommitLog:   node.log,
+			GetServerer: node.log,
+			Metrics:     node.metrics,
+		})
+		require.NoError(t, err)
+		go gsrv.Serve(ln)
+		go m.Serve()
+		t.Cleanup(func() {
+			gsrv.Stop()
+			node.log.Close()
+			m.Close()
+		})
+
+		if i == 0 {
+			require.NoError(t, node.log.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, nodes[0].log.Join(
+				fmt.Sprintf("%d", i),
+				c.Raft.BindAddr,
+			))
+		}
+		nodes = append(nodes, node)
+	}
+	// wait for every server to know the whole cluster and its leader
+	for _, node := range nodes {
+		require.Eventually(t, func() bool {
+			servers, err := node.log.GetServers()
+			if err != nil || len(servers) != n {
+				return false
+			}
+			return servers[0].IsLeader
+		}, 3*time.Second, 10*time.Millisecond)
+	}
+	return nodes
+}
@@ -0,0 +1,100 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Codec is the compression codec the segment applies to each frame it writes,
+whether the frame holds a batch of records or a single one. The frame's
+attributes record the codec it was written with, so a segment can hold frames
+written with different codecs, as it will after the configured codec changes,
+and we can still read every one of them.
+*/
+type Codec string
+
+const (
+	CodecNone   Codec = "none"
+	CodecGzip   Codec = "gzip"
+	CodecSnappy Codec = "snappy"
+	CodecZstd   Codec = "zstd"
+)
+
+/*
+Frame attributes hold a codec as a two bit ID, which must never change for a
+codec since frames already written refer to it.
+*/
+var codecIDs = map[Codec]byte{
+	CodecNone:   0,
+	CodecGzip:   1,
+	CodecSnappy: 2,
+	CodecZstd:   3,
+}
+
+// EncodeAll and DecodeAll are safe to call concurrently, so we share these.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+/*
+compress(c Codec, p []byte) compresses p with the given codec and returns the
+compressed bytes along with the frame attributes that say how to decompress
+them. No codec at all means CodecNone.
+*/
+func compress(c Codec, p []byte) ([]byte, byte, error) {
+	if c == "" {
+		c = CodecNone
+	}
+	id, ok := codecIDs[c]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown codec: %q", c)
+	}
+	attrs := id << attrCodecShift
+	switch c {
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, 0, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, 0, err
+		}
+		return buf.Bytes(), attrs, nil
+	case CodecSnappy:
+		return snappy.Encode(nil, p), attrs, nil
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(p, nil), attrs, nil
+	default:
+		return p, attrs, nil
+	}
+}
+
+/*
+decompress(attrs byte, p []byte) decompresses a frame's payload with the codec
+its attributes name.
+*/
+func decompress(attrs byte, p []byte) ([]byte, error) {
+	switch (attrs & attrCodecMask) >> attrCodecShift {
+	case codecIDs[CodecGzip]:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case codecIDs[CodecSnappy]:
+		return snappy.Decode(nil, p)
+	case codecIDs[CodecZstd]:
+		return zstdDecoder.DecodeAll(p, nil)
+	default:
+		return p, nil
+	}
+}
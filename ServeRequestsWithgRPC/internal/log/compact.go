@@ -0,0 +1,271 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+)
+
+/*
+Compaction writes the segments it rewrites to this directory inside the log's
+directory before moving them into place.
+*/
+const compactionDir = "compaction"
+
+/*
+Compact() compacts the log's closed segments so that, for every key, only the
+latest record with that key survives. Records without a key are always kept.
+A record with a key and no value is a tombstone, saying the key was deleted;
+we keep the latest tombstone for a key until it's older than the configured
+delete retention, so that consumers have time to see it, and then drop it
+too. We take every segment into account when we work out which record is the
+latest for a key, including the active one, but we only ever rewrite the
+closed segments, since the active one is still taking appends.
+
+Surviving records keep their original offsets, so consumers' offsets stay
+valid and the log's indexes become sparse. Reading an offset whose record was
+compacted away returns the next record that survived. A closed segment left
+with no records is removed, except for the log's first segment, which we keep
+even if it's empty so that the log's lowest offset doesn't move.
+
+Reading and rewriting the closed segments is the slow part, so we only hold
+the log's lock to scan the active segment and, at the end, to swap the
+rewritten segments in; in between, appends and reads carry on. We hold the
+closed segments the way a log reader does, so that truncation or retention
+dropping one of them in the meantime doesn't remove its files from under us,
+and we leave a dropped segment's rewrite behind. Records appended while we
+work can only make older records stale, which the next compaction catches.
+*/
+func (l *Log) Compact() (err error) {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+
+	l.mu.RLock()
+	if l.done == nil {
+		l.mu.RUnlock()
+		return api.ErrLogClosed{}
+	}
+	if len(l.segments) < 2 {
+		l.mu.RUnlock()
+		return nil
+	}
+	c := l.Config
+	first := l.segments[0]
+	closed := append([]*segment(nil), l.segments[:len(l.segments)-1]...)
+	for _, s := range closed {
+		s.acquire()
+	}
+	defer func() {
+		for _, s := range closed {
+			if rerr := s.release(); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+	}()
+	latest := make(map[string]uint64)
+	setLatest := func(record *api.Record) {
+		if len(record.Key) > 0 && record.Offset >= latest[string(record.Key)] {
+			latest[string(record.Key)] = record.Offset
+		}
+	}
+	err = l.activeSegment.each(setLatest)
+	l.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, s := range closed {
+		if err = s.each(setLatest); err != nil {
+			return err
+		}
+	}
+	deleteBefore := time.Now().Add(-c.Compaction.DeleteRetention)
+	keep := func(record *api.Record) bool {
+		if len(record.Key) == 0 {
+			return true
+		}
+		if latest[string(record.Key)] != record.Offset {
+			return false
+		}
+		tombstone := len(record.Value) == 0
+		return !tombstone || !record.Timestamp.AsTime().Before(deleteBefore)
+	}
+
+	dir := path.Join(l.Dir, compactionDir)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	var rewrites []rewrite
+	for _, s := range closed {
+		r, err := compactSegment(s, dir, c, keep, s == first)
+		if err != nil {
+			return err
+		}
+		if r.rewritten || r.dropped {
+			rewrites = append(rewrites, r)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done == nil {
+		return api.ErrLogClosed{}
+	}
+	for _, r := range rewrites {
+		if err = l.swap(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+rewrite is what compaction does to a closed segment: drop it, or replace its
+files with the rewritten ones in the compaction directory, which files holds
+in the order we move them.
+*/
+type rewrite struct {
+	segment   *segment
+	dropped   bool
+	rewritten bool
+	files     []string
+}
+
+/*
+compactSegment(s, dir, c, keep, keepEmpty) writes the segment's records that
+keep returns true for to a new segment in the compaction directory. If it
+would keep every record, we leave the segment as it is; if it would keep none
+and keepEmpty is false, we drop it. We close the new segment, so that its
+indexes are trimmed to their entries, before the log swaps its files in; if
+writing it fails, we close it too, and the compaction directory goes with
+whatever we wrote.
+*/
+func compactSegment(
+	s *segment,
+	dir string,
+	c Config,
+	keep func(*api.Record) bool,
+	keepEmpty bool,
+) (r rewrite, err error) {
+	r.segment = s
+	var survivors []*api.Record
+	removed := false
+	if err = s.each(func(record *api.Record) {
+		if keep(record) {
+			survivors = append(survivors, record)
+		} else {
+			removed = true
+		}
+	}); err != nil {
+		return r, err
+	}
+	if !removed {
+		return r, nil
+	}
+	if len(survivors) == 0 && !keepEmpty {
+		r.dropped = true
+		return r, nil
+	}
+
+	n, err := newSegment(dir, s.baseOffset, c)
+	if err != nil {
+		return r, err
+	}
+	for _, record := range survivors {
+		if err = n.write(record); err != nil {
+			n.Close()
+			return r, err
+		}
+	}
+	// the records are as old as they were, so the new segment's files
+	// keep the old one's modification time for retention to go by
+	n.modified = s.modified
+	if err = n.Sync(); err != nil {
+		n.Close()
+		return r, err
+	}
+	if err = n.Close(); err != nil {
+		return r, err
+	}
+	r.rewritten = true
+	r.files = []string{n.index.Name(), n.timeIndex.Name(), n.store.Name()}
+	return r, nil
+}
+
+/*
+swap(r rewrite) puts a compacted segment in place of the one it was compacted
+from, if the log still has that one. We move the rewritten segment's files
+over the old segment's and move the store last, so that both stores are whole
+whatever happens. If a move fails partway, the old segment keeps reading
+through the files it has open, but its files on disk are a mix of old and
+new; we mark the log unclean, so that closing it doesn't write the clean
+shutdown marker and its next start rebuilds the indexes from whichever store
+is in place. The old segment stays open for any reader still reading it, but
+since its files have been replaced, retiring it only closes them. We open the
+new segment before we retire the old one, so that if opening it fails, the
+old one is still there to read.
+*/
+func (l *Log) swap(r rewrite) error {
+	i := -1
+	for j, s := range l.segments {
+		if s == r.segment {
+			i = j
+		}
+	}
+	if i < 0 || (r.dropped && i == 0) {
+		return nil
+	}
+	if r.dropped {
+		l.segments = append(l.segments[:i:i], l.segments[i+1:]...)
+		return r.segment.retire()
+	}
+	for _, name := range r.files {
+		if err := os.Rename(name, path.Join(l.Dir, path.Base(name))); err != nil {
+			l.unclean = true
+			return err
+		}
+	}
+	s, err := newSegment(l.Dir, r.segment.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	l.segments[i] = s
+	return r.segment.replace()
+}
+
+/*
+each(fn) calls fn with every record in the segment, in offset order, skipping
+over the gaps compaction left. We walk the store's frames rather than the
+index, since compaction reads the closed segments outside the log's lock,
+when only the store is safe to read: closing the log unmaps the indexes, but
+reading a closed store just fails.
+*/
+func (s *segment) each(fn func(*api.Record)) error {
+	next := s.baseOffset
+	size := s.store.size
+	for pos := uint64(0); pos < size; {
+		f, err := s.store.ReadFrame(pos)
+		if err == errCorruptFrame {
+			return api.ErrCorruptRecord{Offset: next}
+		}
+		if err != nil {
+			return err
+		}
+		records, err := s.decodeFrame(f)
+		if errors.As(err, &keyError{}) {
+			return err
+		}
+		if err != nil {
+			return api.ErrCorruptRecord{Offset: next}
+		}
+		for _, record := range records {
+			fn(record)
+			next = record.Offset + 1
+		}
+		pos += f.width
+	}
+	return nil
+}
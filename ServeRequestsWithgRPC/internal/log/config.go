@@ -1,9 +1,101 @@
 package log
 
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
 type Config struct {
-	Segment struct {
+	// MaxRecordBytes is the largest record, encoded, the log appends;
+	// larger ones get an api.ErrRecordTooLarge. Zero defaults it to the
+	// segment's MaxStoreBytes, so a record always fits in a segment.
+	MaxRecordBytes uint64
+	Segment        struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// TimeIndexIntervalBytes is how many store bytes go by between
+		// entries in a segment's sparse time index.
+		TimeIndexIntervalBytes uint64
+		// MaxAge rolls the active segment once it's been open this long,
+		// no matter its size. Zero disables time-based rolling.
+		MaxAge time.Duration
+	}
+	Compression struct {
+		// Codec compresses each frame the segments write, a batch of
+		// records or a single one.
+		Codec Codec
+	}
+	Encryption struct {
+		// KeyProvider encrypts the records the segments write with its
+		// current key. Nil leaves them unencrypted.
+		KeyProvider KeyProvider
+	}
+	Retention struct {
+		// Duration deletes segments whose newest record is older than this.
+		Duration time.Duration
+		// Bytes deletes the oldest segments while the log is larger than this.
+		Bytes uint64
+		// CheckInterval is how often the janitor enforces the retention
+		// policy and compacts the log. The janitor only runs when Duration
+		// or Bytes is set or compaction is enabled.
+		CheckInterval time.Duration
+	}
+	Compaction struct {
+		// Enabled has the janitor compact the log's closed segments down
+		// to the latest record for each key.
+		Enabled bool
+		// DeleteRetention is how long compaction keeps a tombstone, so
+		// that consumers have time to see the key was deleted.
+		DeleteRetention time.Duration
+	}
+	Durability struct {
+		// Mode chooses when appended records are synced to disk.
+		Mode DurabilityMode
+		// Records is how many appends DurabilityEveryNRecords lets pass
+		// between syncs.
+		Records uint64
+		// Interval is how often DurabilityInterval's background syncer runs.
+		Interval time.Duration
+	}
+	// Raft configures a DistributedLog's Raft server. Its LocalID names
+	// the server in the cluster, and the timeouts, when set, replace Raft's
+	// defaults.
+	Raft struct {
+		raft.Config
+		// BindAddr is the address the other servers reach this one's
+		// StreamLayer on.
+		BindAddr    string
+		StreamLayer *StreamLayer
+		// RPCAddr looks up the address the server with the given ID
+		// serves its RPCs on, for GetServers, such as from the tags a
+		// discovery.Membership shares. Nil, or a server it doesn't
+		// know, reports the server's Raft address, which is only its
+		// RPC address too when it serves Raft and gRPC on one port.
+		RPCAddr func(id string) (string, bool)
+		// Bootstrap starts a new cluster with this server as its only
+		// member, unless the server already has Raft state.
+		Bootstrap bool
 	}
 }
+
+/*
+DurabilityMode decides when the log syncs appended records from the store's
+buffer and the index's memory map to stable storage. The more often we sync,
+the fewer acknowledged records a power failure can lose and the slower each
+append gets.
+*/
+type DurabilityMode string
+
+const (
+	// DurabilityNone leaves syncing to the OS and to closing the log.
+	DurabilityNone DurabilityMode = "none"
+	// DurabilityEveryNRecords syncs after every Durability.Records appends.
+	DurabilityEveryNRecords DurabilityMode = "every-n-records"
+	// DurabilityInterval syncs in the background every Durability.Interval,
+	// committing every record appended in the meantime as one group.
+	DurabilityInterval DurabilityMode = "interval"
+	// DurabilityAlways syncs before every append returns.
+	DurabilityAlways DurabilityMode = "always"
+)
@@ -0,0 +1,831 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+DistributedLog is a log replicated across the servers in the cluster with
+Raft. Appends go through the Raft leader, which replicates them to the
+followers, and every server applies the appends Raft commits to its own log,
+so every server's log holds the same records at the same offsets, with no
+cycles and no server that can't tell whose records are whose. Reads go to the
+local log, so a follower may be a little behind the leader.
+*/
+type DistributedLog struct {
+	config      Config
+	log         *Log
+	raftLog     *logStore
+	stableStore *raftboltdb.BoltStore
+	raft        *raft.Raft
+}
+
+/*
+applyTimeout is how long an append waits for Raft to commit it.
+*/
+const applyTimeout = 10 * time.Second
+
+/*
+NewDistributedLog(dataDir string, config Config) sets up the server's log and
+its Raft server in the given directory, bootstrapping a new cluster if the
+config says to.
+*/
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	l := &DistributedLog{
+		config: config,
+	}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+/*
+setupLog(dataDir) sets up the server's log. We don't compact it: a snapshot
+restores the records that survived compaction at consecutive offsets, which
+would give them different offsets on the server that restored it.
+*/
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := path.Join(dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	config := l.config
+	config.Compaction.Enabled = false
+	var err error
+	l.log, err = NewLog(logDir, config)
+	return err
+}
+
+/*
+setupRaft(dataDir) creates the Raft server from its parts: the finite-state
+machine that applies the commands Raft commits to our log; the log store
+where Raft keeps the commands, which is a log of our own; the stable store
+where it keeps its metadata, like the current term; the snapshot store for
+the snapshots it compacts the log store with; and the transport it talks to
+the other servers through, over our stream layer.
+
+The log store's records are Raft's log entries, so it starts at offset 1, as
+Raft's indexes do, and we manage its segments the way Raft asks rather than
+with the retention policy or compaction. Its records wrap the records the
+server's log has already checked the size of, a batch of them in one, so we
+don't limit their size. Raft counts on the entries it stores being on disk,
+so we sync every append. Raft applies the commands again when it restarts, so
+a server that already has Raft state starts with an empty log for Raft to
+rebuild.
+*/
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	fsm := &fsm{log: l.log}
+
+	logDir := path.Join(dataDir, "raft", "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	logConfig := l.config
+	logConfig.MaxRecordBytes = math.MaxUint64
+	logConfig.Segment.InitialOffset = 1
+	logConfig.Retention.Duration = 0
+	logConfig.Retention.Bytes = 0
+	logConfig.Compaction.Enabled = false
+	logConfig.Durability.Mode = DurabilityAlways
+	var err error
+	if l.raftLog, err = newLogStore(logDir, logConfig); err != nil {
+		return err
+	}
+	l.stableStore, err = raftboltdb.NewBoltStore(
+		path.Join(dataDir, "raft", "stable"),
+	)
+	if err != nil {
+		return err
+	}
+	output := l.config.Raft.LogOutput
+	if output == nil {
+		output = os.Stderr
+	}
+	retain := 1
+	snapshotStore, err := raft.NewFileSnapshotStore(
+		path.Join(dataDir, "raft"),
+		retain,
+		output,
+	)
+	if err != nil {
+		return err
+	}
+	maxPool := 5
+	timeout := 10 * time.Second
+	transport := raft.NewNetworkTransport(
+		l.config.Raft.StreamLayer,
+		maxPool,
+		timeout,
+		output,
+	)
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	config.Logger = l.config.Raft.Logger
+	config.LogOutput = output
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+	if l.config.Raft.TrailingLogs != 0 {
+		config.TrailingLogs = l.config.Raft.TrailingLogs
+	}
+	hasState, err := raft.HasExistingState(
+		l.raftLog,
+		l.stableStore,
+		snapshotStore,
+	)
+	if err != nil {
+		return err
+	}
+	if hasState {
+		// Raft rebuilds the log when it starts, from its latest snapshot
+		// and the commands committed after it
+		if err = l.log.Reset(); err != nil {
+			return err
+		}
+	}
+	l.raft, err = raft.NewRaft(
+		config,
+		fsm,
+		l.raftLog,
+		l.stableStore,
+		snapshotStore,
+		transport,
+	)
+	if err != nil {
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		config := raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: raft.ServerAddress(l.config.Raft.BindAddr),
+			}},
+		}
+		err = l.raft.BootstrapCluster(config).Error()
+	}
+	return err
+}
+
+/*
+Append(record *api.Record) has Raft append the record to every server's log
+and returns the record's offset. We check the record's size here, so that a
+record too large for the log fails before Raft replicates it.
+*/
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	if err := l.log.checkSize(record); err != nil {
+		return 0, err
+	}
+	res, err := l.apply(
+		AppendRequestType,
+		&api.ProduceRequest{Record: record},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+/*
+AppendBatch(records []*api.Record) has Raft append the records to every
+server's log as one batch, like Log.AppendBatch, and returns the first
+record's offset.
+*/
+func (l *DistributedLog) AppendBatch(records []*api.Record) (uint64, error) {
+	for _, record := range records {
+		if err := l.log.checkSize(record); err != nil {
+			return 0, err
+		}
+	}
+	res, err := l.apply(
+		AppendBatchRequestType,
+		&api.ProduceBatchRequest{Records: records},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceBatchResponse).BaseOffset, nil
+}
+
+/*
+apply(reqType, req) has Raft replicate the request to the servers and apply
+it to their logs once a majority have it, and returns what our finite-state
+machine returned applying it. We encode the request type in the command's
+first byte, so the finite-state machine knows how to decode the rest. Only
+the leader can apply commands; on a follower, Raft fails with
+raft.ErrNotLeader, which we return as unavailable.
+*/
+func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
+	interface{},
+	error,
+) {
+	var buf bytes.Buffer
+	if err := buf.WriteByte(byte(reqType)); err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = buf.Write(b); err != nil {
+		return nil, err
+	}
+	future := l.raft.Apply(buf.Bytes(), applyTimeout)
+	if future.Error() != nil {
+		return nil, unavailable(future.Error())
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+/*
+The reads go to the local log.
+*/
+func (l *DistributedLog) Read(off uint64) (*api.Record, error) {
+	return l.log.Read(off)
+}
+
+func (l *DistributedLog) OffsetForTime(t time.Time) (uint64, error) {
+	return l.log.OffsetForTime(t)
+}
+
+func (l *DistributedLog) WaitForOffset(ctx context.Context, off uint64) error {
+	return l.log.WaitForOffset(ctx, off)
+}
+
+func (l *DistributedLog) Offsets() (low, high uint64, err error) {
+	return l.log.Offsets()
+}
+
+func (l *DistributedLog) Stats() (*api.LogStats, error) {
+	return l.log.Stats()
+}
+
+func (l *DistributedLog) Durability() api.Durability {
+	return l.log.Durability()
+}
+
+/*
+Join(id, addr string) adds the server with the given ID and Raft address to
+the cluster as a voter. It's a discovery.Handler, so the leader can add the
+servers as they join the cluster; on a follower, it fails with
+raft.ErrNotLeader. A server already in the cluster under the same ID or
+address but not both is removed first, since it must have restarted with a
+new ID or address.
+*/
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// the server has already joined
+				return nil
+			}
+			removeFuture := l.raft.RemoveServer(srv.ID, 0, 0)
+			if err := removeFuture.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+/*
+Leave(id string) removes the server with the given ID from the cluster. If
+the leader leaves, the others elect a new one.
+*/
+func (l *DistributedLog) Leave(id string) error {
+	return l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+/*
+GetServers() lists the servers in Raft's configuration, with the RPC address
+the config's RPCAddr looks up for each, and which of them is the leader, as
+far as this server knows. For a server it can't look up, we report the
+address Raft dials it on, which is the server's RPC address too when Raft and
+gRPC share the server's port through a mux.
+*/
+func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, unavailable(err)
+	}
+	_, leaderID := l.raft.LeaderWithID()
+	var servers []*api.Server
+	for _, server := range future.Configuration().Servers {
+		addr := string(server.Address)
+		if l.config.Raft.RPCAddr != nil {
+			if rpcAddr, ok := l.config.Raft.RPCAddr(string(server.ID)); ok {
+				addr = rpcAddr
+			}
+		}
+		servers = append(servers, &api.Server{
+			Id:       string(server.ID),
+			RpcAddr:  addr,
+			IsLeader: server.ID == leaderID,
+		})
+	}
+	return servers, nil
+}
+
+/*
+WaitForLeader(timeout time.Duration) blocks until the cluster has elected a
+leader, or the timeout runs out.
+*/
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for a leader")
+		case <-ticker.C:
+			if addr, _ := l.raft.LeaderWithID(); addr != "" {
+				return nil
+			}
+		}
+	}
+}
+
+/*
+Close() shuts down the Raft server and then closes its stores and the log.
+*/
+func (l *DistributedLog) Close() error {
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := l.stableStore.Close(); err != nil {
+		return err
+	}
+	if err := l.raftLog.Close(); err != nil {
+		return err
+	}
+	return l.log.Close()
+}
+
+/*
+RequestType is the kind of command the first byte of a Raft log entry's data
+says the rest of it is.
+*/
+type RequestType uint8
+
+const (
+	AppendRequestType      RequestType = 0
+	AppendBatchRequestType RequestType = 1
+)
+
+var _ raft.FSM = (*fsm)(nil)
+
+/*
+fsm is the finite-state machine Raft applies the commands it commits to. Its
+state is our log.
+*/
+type fsm struct {
+	log *Log
+}
+
+/*
+Apply(record *raft.Log) applies a committed command to the log and returns the
+response, or the error appending failed with, for apply() to return.
+*/
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	if len(buf) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	reqType := RequestType(buf[0])
+	switch reqType {
+	case AppendRequestType:
+		return f.applyAppend(buf[1:])
+	case AppendBatchRequestType:
+		return f.applyAppendBatch(buf[1:])
+	}
+	return fmt.Errorf("unknown request type: %d", reqType)
+}
+
+func (f *fsm) applyAppend(b []byte) interface{} {
+	var req api.ProduceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	offset, err := f.log.Append(req.Record)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: offset}
+}
+
+func (f *fsm) applyAppendBatch(b []byte) interface{} {
+	var req api.ProduceBatchRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	offset, err := f.log.AppendBatch(req.Records)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceBatchResponse{
+		BaseOffset: offset,
+		LastOffset: offset + uint64(len(req.Records)) - 1,
+	}
+}
+
+/*
+Snapshot() returns a snapshot of the log's state for Raft to persist, so it
+can compact its log store and bring servers that are far behind up to date
+without replaying every command. The state is the log's stores, which
+Log.Reader() streams as they are now: Raft persists the snapshot while it
+applies more commands, whose records mustn't end up in it.
+*/
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{reader: f.log.Reader()}, nil
+}
+
+/*
+Restore(r io.ReadCloser) replaces the log with the one in a snapshot. We read
+the snapshot's frames and decode their records, and before appending the
+first record we reset the log to start at its offset, so that the records
+keep their offsets.
+*/
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	max := maxFrameBytes(f.log.Config)
+	reset := false
+	for {
+		frame, err := readFrame(r, max)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		records, err := decodeFrame(f.log.Config, frame)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if !reset {
+				if err = f.log.resetTo(record.Offset); err != nil {
+					return err
+				}
+				reset = true
+			}
+			if _, err = f.log.Append(record); err != nil {
+				return err
+			}
+		}
+	}
+	if !reset {
+		return f.log.Reset()
+	}
+	return nil
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader io.ReadCloser
+}
+
+/*
+Persist(sink raft.SnapshotSink) writes the log's stores to the sink Raft gives
+us, which writes them to the snapshot store. If writing fails, we cancel the
+sink and release the segments we didn't finish reading.
+*/
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		_ = sink.Cancel()
+		_ = s.reader.Close()
+		return err
+	}
+	return sink.Close()
+}
+
+/*
+Release() releases the log's segments, which Raft calls once it's done with
+the snapshot, whether or not it persisted it.
+*/
+func (s *snapshot) Release() {
+	_ = s.reader.Close()
+}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+/*
+logStore keeps Raft's log entries in a log of our own, one record per entry,
+at the entry's index.
+*/
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{log}, nil
+}
+
+/*
+FirstIndex() and LastIndex() return the indexes of the store's first and last
+entries, or zero for both if the store is empty, as Raft expects. A store Raft
+emptied starts after the entries it deleted, so its offsets would have Raft
+look for the last entry it deleted when it restarts.
+*/
+func (l *logStore) FirstIndex() (uint64, error) {
+	low, next, err := l.Offsets()
+	if err != nil || low == next {
+		return 0, err
+	}
+	return low, nil
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	low, next, err := l.Offsets()
+	if err != nil || low == next {
+		return 0, err
+	}
+	return next - 1, nil
+}
+
+/*
+GetLog(index uint64, out *raft.Log) reads the entry at the given index into
+out, or returns raft.ErrLogNotFound if the store doesn't have it, which tells
+the leader to send a follower a snapshot instead.
+*/
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if in.Offset != index {
+		// compaction never runs on the store, so this is a gap we
+		// didn't write
+		return raft.ErrLogNotFound
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+/*
+StoreLogs(records []*raft.Log) appends the entries to the store. Raft hands us
+the entries in order, right after the last one we have, so each gets its
+index as its offset. The exception is an empty store, which Raft may have
+emptied to install a snapshot and then fills from the entry after the
+snapshot's last, so we start it over at the first entry's index. If an entry
+still wouldn't get its index, the store and Raft disagree and we fail rather
+than store it under the wrong index.
+*/
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	if len(records) == 0 {
+		return nil
+	}
+	low, next, err := l.Offsets()
+	if err != nil {
+		return err
+	}
+	if low == next && records[0].Index != low {
+		if err = l.resetTo(records[0].Index); err != nil {
+			return err
+		}
+		next = records[0].Index
+	}
+	for _, record := range records {
+		if record.Index != next {
+			return fmt.Errorf(
+				"raft log entry %d out of order, expected %d",
+				record.Index, next,
+			)
+		}
+		if _, err = l.Append(&api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}); err != nil {
+			return err
+		}
+		next++
+	}
+	return nil
+}
+
+/*
+IsMonotonic() tells Raft the store can't have gaps between its entries'
+indexes, so after installing a snapshot Raft deletes every entry rather than
+leave a gap before the next one.
+*/
+func (l *logStore) IsMonotonic() bool {
+	return true
+}
+
+/*
+DeleteRange(min, max uint64) deletes the entries from min to max, inclusive.
+Raft deletes the oldest entries once a snapshot covers them, which we do by
+truncating the store's segments, so some of them may linger until their
+segment is all covered. It deletes the newest entries when a new leader's log
+disagrees with ours, and every entry after installing a snapshot, in which
+case we reset the store to start after them.
+*/
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	last, err := l.HighestOffset()
+	if err != nil {
+		return err
+	}
+	switch {
+	case min <= first && max >= last:
+		return l.resetTo(max + 1)
+	case max >= last:
+		return l.deleteFrom(min)
+	}
+	return l.Truncate(max)
+}
+
+/*
+deleteFrom(off uint64) deletes the records at and after the given offset. We
+evict the segments that start at or after it, since a new segment may reuse
+their base offsets, and cut the segment holding the offset short at the
+offset's frame, rebuilding its indexes from what's left of its store. That
+segment becomes the active one again; if there's none, because the first
+segment started at the offset, we create a new one there.
+*/
+func (l *Log) deleteFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done == nil {
+		return api.ErrLogClosed{}
+	}
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset >= off {
+			if err := s.evict(); err != nil {
+				return unavailable(err)
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	if len(segments) == 0 {
+		return unavailable(l.newSegment(off))
+	}
+	s := segments[len(segments)-1]
+	l.activeSegment = s
+	if off >= s.nextOffset {
+		return nil
+	}
+	_, pos, err := s.index.Find(uint32(off - s.baseOffset))
+	if err != nil {
+		return unavailable(err)
+	}
+	if err = s.store.truncate(pos); err != nil {
+		return unavailable(err)
+	}
+	if _, _, err = s.recover(); err != nil {
+		return unavailable(err)
+	}
+	s.dirty = true
+	return unavailable(s.Sync())
+}
+
+/*
+RaftRPC is the first byte of every connection the stream layer dials, which
+tells the server accepting it that it's for Raft, so that Raft can share a
+listener with other traffic.
+*/
+const RaftRPC = 1
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+/*
+StreamLayer is the transport Raft's servers connect to each other over: a
+listener, and connections dialed to the other servers' listeners, with TLS if
+configured. serverTLSConfig secures the connections we accept and
+peerTLSConfig the ones we dial.
+*/
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+func NewStreamLayer(
+	ln net.Listener,
+	serverTLSConfig,
+	peerTLSConfig *tls.Config,
+) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+/*
+Dial(addr raft.ServerAddress, timeout time.Duration) connects to another
+server, writes the RaftRPC byte, and starts TLS if configured.
+*/
+func (s *StreamLayer) Dial(
+	addr raft.ServerAddress,
+	timeout time.Duration,
+) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte{byte(RaftRPC)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+	return conn, nil
+}
+
+/*
+Accept() accepts a connection from another server, checks its first byte is
+RaftRPC, and starts TLS if configured.
+*/
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+		conn.Close()
+		return nil, fmt.Errorf("not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
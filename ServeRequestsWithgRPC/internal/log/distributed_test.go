@@ -0,0 +1,349 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+TestMultipleNodes(*testing.T) runs a cluster of three servers on loopback and
+checks that the records appended through the leader are replicated to every
+server, that a follower can't append, and that once the leader fails the
+other two elect a new leader and carry on appending.
+*/
+func TestMultipleNodes(t *testing.T) {
+	var logs []*DistributedLog
+	nodeCount := 3
+	for i := 0; i < nodeCount; i++ {
+		l := setupDistributedLog(t, i)
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(
+				fmt.Sprintf("%d", i),
+				l.config.Raft.BindAddr,
+			))
+		}
+		logs = append(logs, l)
+	}
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(record)
+		require.NoError(t, err)
+		requireReplicated(t, logs, off, record.Value)
+	}
+	_, err := logs[1].Append(&api.Record{Value: []byte("follower")})
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+
+	// the leader fails, and the other two hold an election
+	require.NoError(t, logs[0].Close())
+	var leader *DistributedLog
+	require.Eventually(t, func() bool {
+		for _, l := range logs[1:] {
+			if l.raft.State() == raft.Leader {
+				leader = l
+				return true
+			}
+		}
+		return false
+	}, 3*time.Second, 50*time.Millisecond)
+	off, err := leader.Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	requireReplicated(t, logs[1:], off, []byte("third"))
+}
+
+/*
+TestAppendMaxRecordBytes(*testing.T) checks that a record as large as the log
+takes, and a batch of them, fit in Raft's log store too, once wrapped in
+Raft's log entry, and that the server stays the leader after appending them.
+*/
+func TestAppendMaxRecordBytes(t *testing.T) {
+	l := setupDistributedLog(t, 0)
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+	max := l.log.Config.MaxRecordBytes
+	record := func() *api.Record {
+		// a value of n bytes takes a tag and a two-byte length
+		return &api.Record{Value: make([]byte, max-3)}
+	}
+	require.Equal(t, int(max), proto.Size(record()))
+
+	off, err := l.Append(record())
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = l.AppendBatch([]*api.Record{record(), record()})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, raft.Leader, l.raft.State())
+
+	tooLarge := &api.Record{Value: make([]byte, max-2)}
+	_, err = l.Append(tooLarge)
+	require.IsType(t, api.ErrRecordTooLarge{}, err)
+}
+
+/*
+TestSnapshotRestore(*testing.T) checks that restoring the finite-state
+machine from a snapshot of another's log gives a log with the same records at
+the same offsets, and that restoring an empty snapshot empties the log.
+*/
+func TestSnapshotRestore(t *testing.T) {
+	newFSM := func(c Config) *fsm {
+		dir, err := ioutil.TempDir("", "fsm-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { log.Close() })
+		return &fsm{log: log}
+	}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 5
+	src := newFSM(c)
+	for i := 0; i < 5; i++ {
+		_, err := src.log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	_, err := src.log.AppendBatch([]*api.Record{
+		{Value: []byte("batch 0")},
+		{Value: []byte("batch 1")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, src.log.Truncate(6))
+	low, high, err := src.log.Offsets()
+	require.NoError(t, err)
+	require.Greater(t, low, uint64(5))
+
+	snap, err := src.Snapshot()
+	require.NoError(t, err)
+	// Raft applies more commands while it persists the snapshot
+	_, err = src.log.Append(&api.Record{Value: []byte("after snapshot")})
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	dst := newFSM(Config{})
+	_, err = dst.log.Append(&api.Record{Value: []byte("stale")})
+	require.NoError(t, err)
+	require.NoError(t, dst.Restore(ioutil.NopCloser(&sink.Buffer)))
+	dstLow, dstHigh, err := dst.log.Offsets()
+	require.NoError(t, err)
+	require.Equal(t, low, dstLow)
+	require.Equal(t, high, dstHigh)
+	for off := low; off < high; off++ {
+		want, err := src.log.Read(off)
+		require.NoError(t, err)
+		got, err := dst.log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Offset, got.Offset)
+	}
+
+	require.NoError(t, dst.Restore(ioutil.NopCloser(&bytes.Buffer{})))
+	dstLow, dstHigh, err = dst.log.Offsets()
+	require.NoError(t, err)
+	require.Equal(t, dstLow, dstHigh)
+
+	// a snapshot that fails to persist releases the segments
+	snap, err = src.Snapshot()
+	require.NoError(t, err)
+	require.Error(t, snap.Persist(failingSink{}))
+	snap.Release()
+	for _, s := range src.log.segments {
+		require.Equal(t, 0, s.readers)
+	}
+
+	// a record as large as the max record size still fits once the log has
+	// given it an offset and timestamp, so it restores
+	c = Config{}
+	c.MaxRecordBytes = 100
+	src = newFSM(c)
+	large := &api.Record{Value: make([]byte, 98)}
+	require.Equal(t, 100, proto.Size(large))
+	_, err = src.log.Append(large)
+	require.NoError(t, err)
+	snap, err = src.Snapshot()
+	require.NoError(t, err)
+	sink = &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+	dst = newFSM(c)
+	require.NoError(t, dst.Restore(ioutil.NopCloser(&sink.Buffer)))
+	got, err := dst.log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, large.Value, got.Value)
+}
+
+/*
+TestLogStore(*testing.T) tests the Raft log store: that it stores entries at
+their indexes, deletes the oldest and the newest on Raft's request, and, once
+Raft empties it to install a snapshot, starts over at the next entry's index.
+*/
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 1
+	s, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	defer func() { s.Close() }()
+
+	entry := func(index uint64) *raft.Log {
+		return &raft.Log{
+			Index: index,
+			Term:  index,
+			Type:  raft.LogCommand,
+			Data:  []byte(fmt.Sprintf("entry %d", index)),
+		}
+	}
+	requireRange := func(first, last uint64) {
+		t.Helper()
+		got, err := s.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, last, got)
+		for i := first; i <= last; i++ {
+			var out raft.Log
+			require.NoError(t, s.GetLog(i, &out))
+			require.Equal(t, *entry(i), out)
+		}
+	}
+	for i := uint64(1); i <= 6; i++ {
+		require.NoError(t, s.StoreLog(entry(i)))
+	}
+	requireRange(1, 6)
+	require.Error(t, s.StoreLog(entry(8)))
+
+	// a new leader's log disagrees from entry 4 on
+	require.NoError(t, s.DeleteRange(4, 6))
+	requireRange(1, 3)
+	var out raft.Log
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(4, &out))
+	require.NoError(t, s.StoreLogs([]*raft.Log{entry(4), entry(5)}))
+	requireRange(1, 5)
+
+	// a snapshot covers the oldest entries
+	require.NoError(t, s.DeleteRange(1, 3))
+	first, err := s.FirstIndex()
+	require.NoError(t, err)
+	require.Greater(t, first, uint64(1))
+	requireRange(first, 5)
+
+	// Raft installs a snapshot past every entry, and the server restarts
+	require.NoError(t, s.DeleteRange(first, 5))
+	requireEmpty := func() {
+		t.Helper()
+		first, err := s.FirstIndex()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), first)
+		last, err := s.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), last)
+	}
+	requireEmpty()
+	require.NoError(t, s.Close())
+	s, err = newLogStore(dir, c)
+	require.NoError(t, err)
+	requireEmpty()
+	require.NoError(t, s.StoreLog(entry(10)))
+	first, err = s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), first)
+	requireRange(10, 10)
+}
+
+/*
+setupDistributedLog(t, id) starts a server's distributed log on loopback with
+Raft's timeouts cut down so tests elect a leader quickly. The first server
+bootstraps the cluster.
+*/
+func setupDistributedLog(t *testing.T, id int) *DistributedLog {
+	t.Helper()
+	dataDir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dataDir) })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	config := Config{}
+	config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", id))
+	config.Raft.BindAddr = ln.Addr().String()
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.LogOutput = io.Discard
+	config.Raft.Bootstrap = id == 0
+
+	l, err := NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	// closing a log twice fails, and the test closes the leader's itself
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+/*
+requireReplicated(t, logs, off, value) waits for every log to have the record
+with the given value at the given offset.
+*/
+func requireReplicated(
+	t *testing.T,
+	logs []*DistributedLog,
+	off uint64,
+	value []byte,
+) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			got, err := l.Read(off)
+			if err != nil || !bytes.Equal(got.Value, value) {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+/*
+snapshotSink is a raft.SnapshotSink that keeps the snapshot in memory.
+*/
+type snapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *snapshotSink) ID() string    { return "test" }
+func (s *snapshotSink) Cancel() error { return nil }
+func (s *snapshotSink) Close() error  { return nil }
+
+/*
+failingSink is a raft.SnapshotSink that fails every write, like a full disk.
+*/
+type failingSink struct{}
+
+func (failingSink) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("disk full")
+}
+
+func (failingSink) ID() string    { return "test" }
+func (failingSink) Cancel() error { return nil }
+func (failingSink) Close() error  { return nil }
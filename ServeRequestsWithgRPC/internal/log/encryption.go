@@ -0,0 +1,196 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+KeyProvider supplies the AES keys the log encrypts its records with at rest.
+Every key has an ID, and each encrypted frame records the ID of the key that
+encrypted it, so rotating keys only changes the key new frames are encrypted
+with: the provider must keep handing out the old keys by ID for as long as
+frames encrypted with them are in the log.
+*/
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new frames with and its ID.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with the given ID.
+	Key(id uint32) ([]byte, error)
+}
+
+/*
+An encrypted frame's payload starts with the ID of the key that encrypted it
+and the nonce we sealed it with, followed by the sealed payload.
+*/
+var (
+	keyIDWidth = 4
+	nonceWidth = 12
+)
+
+/*
+keyError is a key the frame needs but we couldn't get. Unlike a frame that
+fails to decrypt, it doesn't mean the frame is corrupt, so recovering a
+segment stops at it rather than discarding the frame.
+*/
+type keyError struct {
+	id  uint32
+	err error
+}
+
+func (e keyError) Error() string {
+	return fmt.Sprintf("encryption key %d: %v", e.id, e.err)
+}
+
+func (e keyError) Unwrap() error {
+	return e.err
+}
+
+/*
+encrypt(kp KeyProvider, p []byte) seals p with AES-GCM under the provider's
+current key. We pass the key ID in as additional data, so a frame whose key
+ID was tampered with fails to open rather than opening under another key.
+*/
+func encrypt(kp KeyProvider, p []byte) ([]byte, error) {
+	id, key, err := kp.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, keyError{id: id, err: err}
+	}
+	b := make([]byte, keyIDWidth+nonceWidth, keyIDWidth+nonceWidth+len(p)+gcm.Overhead())
+	enc.PutUint32(b, id)
+	if _, err = io.ReadFull(rand.Reader, b[keyIDWidth:]); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(b, b[keyIDWidth:], p, b[:keyIDWidth]), nil
+}
+
+/*
+decrypt(kp KeyProvider, p []byte) opens an encrypted frame's payload with the
+key whose ID the payload records.
+*/
+func decrypt(kp KeyProvider, p []byte) ([]byte, error) {
+	if len(p) < keyIDWidth+nonceWidth {
+		return nil, errCorruptFrame
+	}
+	id := enc.Uint32(p)
+	if kp == nil {
+		return nil, keyError{id: id, err: errors.New("no key provider")}
+	}
+	key, err := kp.Key(id)
+	if err != nil {
+		return nil, keyError{id: id, err: err}
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, keyError{id: id, err: err}
+	}
+	nonce := p[keyIDWidth : keyIDWidth+nonceWidth]
+	return gcm.Open(nil, nonce, p[keyIDWidth+nonceWidth:], p[:keyIDWidth])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+FileKeyProvider is a KeyProvider that keeps its keys in a directory, one file
+per key named after the key's ID, such as 1.key, holding the hex-encoded
+16, 24 or 32 byte AES key. The current key is the one with the highest ID, so
+rotating the key means writing a file with a higher ID and reloading the
+provider. Keep the old files around until no segment still uses them.
+*/
+type FileKeyProvider struct {
+	dir     string
+	mu      sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+/*
+NewFileKeyProvider(dir string) creates a provider for the keys in the given
+directory and loads them.
+*/
+func NewFileKeyProvider(dir string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{dir: dir}
+	return p, p.Reload()
+}
+
+/*
+Reload() reads the keys from the provider's directory again, picking up keys
+added since it last read them.
+*/
+func (p *FileKeyProvider) Reload() error {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	keys := make(map[uint32][]byte)
+	var current uint32
+	for _, entry := range entries {
+		idStr := strings.TrimSuffix(entry.Name(), ".key")
+		if entry.IsDir() || idStr == entry.Name() {
+			continue
+		}
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			return fmt.Errorf("key file name %q: %w", entry.Name(), err)
+		}
+		b, err := os.ReadFile(path.Join(p.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return fmt.Errorf("key file %q: %w", entry.Name(), err)
+		}
+		if _, err = aes.NewCipher(key); err != nil {
+			return fmt.Errorf("key file %q: %w", entry.Name(), err)
+		}
+		keys[uint32(id)] = key
+		if uint32(id) > current || len(keys) == 1 {
+			current = uint32(id)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys in %s", p.dir)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.current = current
+	return nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *FileKeyProvider) Key(id uint32) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key")
+	}
+	return key, nil
+}
@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -28,7 +29,9 @@ Creates an index for the given file. We create the index and save the current si
 of the file so we can track the amount of data in the index file as we add index
 entries. We grow the file to the max index size before memory-mapping the file
 (The reason we resize them now is that, once they’re memory-mapped, we can’t resize
- them, so it’s now or never) and then return the created index to the caller.
+ them, so it’s now or never) and then return the created index to the caller. We
+never shrink a file that's already larger than the max, since that would cut off
+its entries.
 */
 func newIndex(f *os.File, c Config) (*index, error) {
 	idx := &index{
@@ -41,10 +44,12 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	}
 
 	idx.size = uint64(fi.Size())
-	if err = os.Truncate(
-		f.Name(), int64(c.Segment.MaxIndexBytes),
-	); err != nil {
-		return nil, err
+	if idx.size < c.Segment.MaxIndexBytes {
+		if err = os.Truncate(
+			f.Name(), int64(c.Segment.MaxIndexBytes),
+		); err != nil {
+			return nil, err
+		}
 	}
 
 	if idx.mmap, err = gommap.Map(
@@ -77,6 +82,15 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
+/*
+Syncs the memory-mapped file's entries to the persisted file. The file was
+grown to its full size before we mapped it, so there's no file metadata to
+sync as entries get written.
+*/
+func (i *index) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
@@ -109,6 +123,32 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+/*
+Find(rel uint32) returns the entry for the first record at or after the given
+relative offset. Until a segment is compacted, its index holds an entry for
+every offset, so the entry for relative offset n is the nth entry and we read
+it directly. Compaction leaves gaps where it removed records, so when the nth
+entry isn't the one we're after, we binary search the entries, which are
+still sorted by offset. If every entry is before the offset, we return io.EOF.
+*/
+func (i *index) Find(rel uint32) (out uint32, pos uint64, err error) {
+	n := i.size / entWidth
+	if uint64(rel) < n {
+		out, pos, err = i.Read(int64(rel))
+		if err != nil || out == rel {
+			return out, pos, err
+		}
+	}
+	e := sort.Search(int(n), func(e int) bool {
+		off, _, _ := i.Read(int64(e))
+		return off >= rel
+	})
+	if uint64(e) == n {
+		return 0, 0, io.EOF
+	}
+	return i.Read(int64(e))
+}
+
 /*
 Appends the given offset and position to the index.
 First, we validate that we have space to write the entry. If there’s space, we
@@ -68,3 +68,27 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, entries[1].Pos, pos)
 
 }
+
+func TestIndexFind(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_find_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	// a compacted index has gaps where records were removed
+	for _, off := range []uint32{0, 1, 4, 7} {
+		require.NoError(t, idx.Write(off, uint64(off)*10))
+	}
+	for in, want := range map[uint32]uint32{0: 0, 1: 1, 2: 4, 4: 4, 5: 7, 7: 7} {
+		out, pos, err := idx.Find(in)
+		require.NoError(t, err)
+		require.Equal(t, want, out)
+		require.Equal(t, uint64(want)*10, pos)
+	}
+	_, _, err = idx.Find(8)
+	require.Equal(t, io.EOF, err)
+}
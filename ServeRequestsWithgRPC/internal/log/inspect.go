@@ -0,0 +1,455 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+)
+
+/*
+The functions in this file look inside a log's directory without setting the
+log up, for tools that inspect and repair a log that isn't running. Setting
+the log up would recover its segments if it wasn't shut down cleanly, which
+would fix the very problems we want to look at, so everything but Repair
+opens the files read-only.
+*/
+
+/*
+SegmentInfo describes a segment on disk: its base offset, the offset after
+its last indexed record, the sizes of its store, index and time index files,
+and how many records its index holds.
+*/
+type SegmentInfo struct {
+	BaseOffset     uint64
+	NextOffset     uint64
+	StoreBytes     uint64
+	IndexBytes     uint64
+	TimeIndexBytes uint64
+	Records        uint64
+}
+
+/*
+Inspection describes a log's directory: whether the log was shut down
+cleanly, and its segments from oldest to newest.
+*/
+type Inspection struct {
+	Clean    bool
+	Segments []SegmentInfo
+}
+
+/*
+Problem is something Verify found wrong with a segment: the position in the
+store it's about and what's wrong there.
+*/
+type Problem struct {
+	BaseOffset uint64
+	Pos        uint64
+	Err        string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("segment %d, position %d: %s", p.BaseOffset, p.Pos, p.Err)
+}
+
+/*
+Inspect(dir string) describes the log in the given directory.
+*/
+func Inspect(dir string) (*Inspection, error) {
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(path.Join(dir, cleanShutdownFile))
+	in := &Inspection{Clean: err == nil}
+	for _, base := range baseOffsets {
+		entries, indexBytes, err := readIndex(indexPath(dir, base))
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(storePath(dir, base))
+		if err != nil {
+			return nil, err
+		}
+		info := SegmentInfo{
+			BaseOffset: base,
+			NextOffset: base,
+			StoreBytes: uint64(fi.Size()),
+			IndexBytes: indexBytes,
+			Records:    uint64(len(entries)),
+		}
+		// a segment written before the log had time indexes has none
+		// until the log next opens it
+		fi, err = os.Stat(timeIndexPath(dir, base))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			info.TimeIndexBytes = uint64(fi.Size())
+		}
+		if len(entries) > 0 {
+			info.NextOffset = base + uint64(entries[len(entries)-1].rel) + 1
+		}
+		in.Segments = append(in.Segments, info)
+	}
+	return in, nil
+}
+
+/*
+Records(dir, c, from, to, fn) calls fn with every record in the log in the
+given directory whose offset is in the range [from, to], in offset order. We
+read the records by walking the segments' stores rather than their indexes, so
+we find them even when an index is wrong. A corrupt frame stops the walk with
+an api.ErrCorruptRecord for the offset after the last record we read, and a
+frame we can't decrypt stops it with the key error. The config must have the
+key provider the records were encrypted with, if they were.
+*/
+func Records(
+	dir string,
+	c Config,
+	from, to uint64,
+	fn func(*api.Record) error,
+) error {
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if err != nil {
+		return err
+	}
+	for i, base := range baseOffsets {
+		if base > to {
+			break
+		}
+		if i+1 < len(baseOffsets) && baseOffsets[i+1] <= from {
+			continue
+		}
+		next := base
+		err = scanStore(dir, base, c, func(pos uint64, records []*api.Record, err error) error {
+			if errors.As(err, &keyError{}) {
+				return err
+			}
+			if err != nil {
+				return api.ErrCorruptRecord{Offset: next}
+			}
+			for _, record := range records {
+				next = record.Offset + 1
+				if record.Offset < from || record.Offset > to {
+					continue
+				}
+				if err = fn(record); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Verify(dir string, c Config) checks every segment of the log in the given
+directory and returns the problems it finds. We check that each index entry
+points at a frame in the store that reads back whole and holds the entry's
+record, and that the entries' offsets go up. Then we walk the store and check
+that every frame reads back whole and that the index has an entry for every
+record in it. A log that wasn't shut down cleanly can have records past the
+end of its index; the log recovers those when it starts.
+*/
+func Verify(dir string, c Config) ([]Problem, error) {
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []Problem
+	for _, base := range baseOffsets {
+		p, err := verifySegment(dir, base, c)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, p...)
+	}
+	return problems, nil
+}
+
+func verifySegment(dir string, base uint64, c Config) ([]Problem, error) {
+	var problems []Problem
+	problem := func(pos uint64, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			BaseOffset: base,
+			Pos:        pos,
+			Err:        fmt.Sprintf(format, args...),
+		})
+	}
+	entries, _, err := readIndex(indexPath(dir, base))
+	if err != nil {
+		return nil, err
+	}
+	s, err := openSegmentReadOnly(dir, base, c)
+	if err != nil {
+		return nil, err
+	}
+	defer s.store.Close()
+
+	indexed := make(map[uint64]bool, len(entries))
+	for i, e := range entries {
+		off := base + uint64(e.rel)
+		indexed[off] = true
+		if i > 0 && e.rel <= entries[i-1].rel {
+			problem(e.pos, "index entry %d has offset %d, not after the previous entry's", i, off)
+		}
+		if e.pos >= s.store.size {
+			problem(e.pos, "index entry for offset %d points past the end of the store", off)
+			continue
+		}
+		f, err := s.store.ReadFrame(e.pos)
+		if err != nil {
+			problem(e.pos, "index entry for offset %d points at a bad frame: %v", off, err)
+			continue
+		}
+		records, err := s.decodeFrame(f)
+		if err != nil {
+			problem(e.pos, "can't decode the frame for offset %d: %v", off, err)
+			continue
+		}
+		found := false
+		for _, record := range records {
+			found = found || record.Offset == off
+		}
+		if !found {
+			problem(e.pos, "the frame the index has for offset %d doesn't hold it", off)
+		}
+	}
+
+	var unindexed uint64
+	err = scanStore(dir, base, c, func(pos uint64, records []*api.Record, err error) error {
+		if err != nil {
+			problem(pos, "%v", err)
+			return nil
+		}
+		for _, record := range records {
+			if !indexed[record.Offset] {
+				unindexed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unindexed > 0 {
+		problem(0, "%d records in the store aren't in the index", unindexed)
+	}
+	return problems, nil
+}
+
+/*
+Repair(dir string, c Config) rebuilds the indexes of every segment of the log
+in the given directory from their stores, and truncates any corrupt or partly
+written frames from the end of the stores, just as the log does when it starts
+after an unclean shutdown. The log must not be running. We size each index for
+the segment we rebuild it from, so the config's max index bytes needn't match
+the running log's.
+*/
+func Repair(dir string, c Config) (*Recovery, error) {
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if err != nil {
+		return nil, err
+	}
+	if c.Segment.TimeIndexIntervalBytes == 0 {
+		c.Segment.TimeIndexIntervalBytes = 4096
+	}
+	r := &Recovery{}
+	for _, base := range baseOffsets {
+		sc := c
+		if sc.Segment.MaxIndexBytes, err = repairIndexBytes(dir, base, c); err != nil {
+			return nil, err
+		}
+		s, err := newSegment(dir, base, sc)
+		if err != nil {
+			return nil, err
+		}
+		records, truncated, err := s.recover()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if err = s.Close(); err != nil {
+			return nil, err
+		}
+		r.Segments++
+		r.Records += records
+		r.TruncatedBytes += truncated
+	}
+	return r, nil
+}
+
+/*
+repairIndexBytes(dir, base, c) returns how large to make a segment's index to
+rebuild it: large enough for an entry for every record in its store, counting
+a corrupt frame we can skip as one, as the segment's recovery does, and never
+smaller than the index file already is or the config's max index bytes.
+*/
+func repairIndexBytes(dir string, base uint64, c Config) (uint64, error) {
+	var entries uint64
+	err := scanStore(dir, base, c, func(pos uint64, records []*api.Record, err error) error {
+		if err != nil {
+			entries++
+		}
+		entries += uint64(len(records))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := entries * entWidth
+	fi, err := os.Stat(indexPath(dir, base))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err == nil && uint64(fi.Size()) > n {
+		n = uint64(fi.Size())
+	}
+	if c.Segment.MaxIndexBytes > n {
+		n = c.Segment.MaxIndexBytes
+	}
+	return n, nil
+}
+
+/*
+segmentBaseOffsets(dir string) returns the base offsets of the segments in the
+given directory, sorted. Every segment has a store file, so we take the base
+offsets from those.
+*/
+func segmentBaseOffsets(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var baseOffsets []uint64
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
+		baseOffsets = append(baseOffsets, off)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return baseOffsets, nil
+}
+
+func storePath(dir string, base uint64) string {
+	return path.Join(dir, fmt.Sprintf("%d%s", base, ".store"))
+}
+
+func indexPath(dir string, base uint64) string {
+	return path.Join(dir, fmt.Sprintf("%d%s", base, ".index"))
+}
+
+func timeIndexPath(dir string, base uint64) string {
+	return path.Join(dir, fmt.Sprintf("%d%s", base, ".timeindex"))
+}
+
+type indexEntry struct {
+	rel uint32
+	pos uint64
+}
+
+/*
+readIndex(name string) reads an index file's entries without memory-mapping
+it, and returns them along with the file's size. An index that wasn't closed
+is still its full preallocated size, with zeroed entries after the last one
+written; since only the first entry can have a zero offset and position, we
+stop at the first zeroed entry after it.
+*/
+func readIndex(name string) ([]indexEntry, uint64, error) {
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var entries []indexEntry
+	for pos := uint64(0); pos+entWidth <= uint64(len(b)); pos += entWidth {
+		e := indexEntry{
+			rel: enc.Uint32(b[pos : pos+offWidth]),
+			pos: enc.Uint64(b[pos+offWidth : pos+entWidth]),
+		}
+		if pos > 0 && e.rel == 0 && e.pos == 0 {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, uint64(len(b)), nil
+}
+
+/*
+openSegmentReadOnly(dir, base, c) opens just the store of a segment, read-only,
+which is all we need to decode its frames.
+*/
+func openSegmentReadOnly(dir string, base uint64, c Config) (*segment, error) {
+	f, err := os.Open(storePath(dir, base))
+	if err != nil {
+		return nil, err
+	}
+	st, err := newStore(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &segment{store: st, baseOffset: base, config: c}, nil
+}
+
+/*
+scanStore(dir, base, c, fn) walks the frames in a segment's store from the
+start and calls fn with each frame's position and records, or the error we got
+reading or decoding it. We skip over a corrupt frame whose header is intact;
+one whose header isn't ends the walk, since we can't tell where the next frame
+starts.
+*/
+func scanStore(
+	dir string,
+	base uint64,
+	c Config,
+	fn func(pos uint64, records []*api.Record, err error) error,
+) error {
+	s, err := openSegmentReadOnly(dir, base, c)
+	if err != nil {
+		return err
+	}
+	defer s.store.Close()
+	var pos uint64
+	for pos < s.store.size {
+		f, err := s.store.ReadFrame(pos)
+		if err != nil && err != errCorruptFrame {
+			return err
+		}
+		var records []*api.Record
+		if err == nil {
+			records, err = s.decodeFrame(f)
+		}
+		if err != nil && f.width == 0 {
+			return fn(pos, nil, fmt.Errorf(
+				"corrupt tail of %d bytes", s.store.size-pos,
+			))
+		}
+		if err = fn(pos, records, err); err != nil {
+			return err
+		}
+		pos += f.width
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+TestInspect(*testing.T) tests inspecting a closed log's segments and records,
+that verifying finds a bad index entry, an unindexed record and a torn tail,
+and that repairing fixes them.
+*/
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	in, err := Inspect(dir)
+	require.NoError(t, err)
+	require.True(t, in.Clean)
+	require.Equal(t, 3, len(in.Segments))
+	for i, s := range in.Segments {
+		require.Equal(t, uint64(i*2), s.BaseOffset)
+		require.NotZero(t, s.StoreBytes)
+		require.NotZero(t, s.TimeIndexBytes)
+	}
+	require.Equal(t, uint64(2), in.Segments[0].Records)
+	require.Equal(t, uint64(2), in.Segments[0].NextOffset)
+	require.Equal(t, entWidth*2, in.Segments[0].IndexBytes)
+	require.Equal(t, uint64(1), in.Segments[2].Records)
+	require.Equal(t, uint64(5), in.Segments[2].NextOffset)
+
+	var values []string
+	err = Records(dir, c, 1, 3, func(record *api.Record) error {
+		values = append(values, string(record.Value))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"record 1", "record 2", "record 3"}, values)
+
+	problems, err := Verify(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	// point the first segment's second index entry past its store, drop the
+	// second segment's last index entry, and tear a write at the end of the
+	// last segment's store
+	f, err := os.OpenFile(indexPath(dir, 0), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	pos := make([]byte, posWidth)
+	enc.PutUint64(pos, 1<<20)
+	_, err = f.WriteAt(pos, int64(entWidth+offWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Truncate(indexPath(dir, 2), int64(entWidth)))
+	f, err = os.OpenFile(storePath(dir, 4), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	torn := make([]byte, lenWidth+crcWidth+5)
+	enc.PutUint64(torn, frameHeader(frameVersion, 0, 100))
+	_, err = f.Write(torn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	problems, err = Verify(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(problems))
+	require.Equal(t, uint64(0), problems[0].BaseOffset)
+	require.Equal(t, uint64(1<<20), problems[0].Pos)
+	require.Equal(t, uint64(2), problems[1].BaseOffset)
+	require.Contains(t, problems[1].Err, "1 records in the store aren't in the index")
+	require.Equal(t, uint64(4), problems[2].BaseOffset)
+	require.Contains(t, problems[2].Err, "corrupt tail")
+
+	err = Records(dir, c, 4, 5, func(*api.Record) error { return nil })
+	require.IsType(t, api.ErrCorruptRecord{}, err)
+	require.Equal(t, uint64(5), err.(api.ErrCorruptRecord).Offset)
+
+	r, err := Repair(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, &Recovery{
+		Segments:       3,
+		Records:        5,
+		TruncatedBytes: uint64(len(torn)),
+	}, r)
+	problems, err = Verify(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := uint64(0); i < 5; i++ {
+		record, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+}
+
+/*
+TestRepairKeepsIndex(*testing.T) repairs a cleanly closed log whose index is
+far larger than the config we repair it with says, like proglog-admin's
+config, which doesn't know the server's limits, and checks that the log still
+reads every record afterwards.
+*/
+func TestRepairKeepsIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repair-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	r, err := Repair(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, &Recovery{Segments: 1, Records: 200}, r)
+	problems, err := Verify(dir, Config{})
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := uint64(0); i < 200; i++ {
+		record, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+}
@@ -1,18 +1,27 @@
 package log
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	api "github.com/SStoyanov22/proglog/api/v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
+/*
+Closing the log writes this marker file to its directory, and setting the log
+up removes it again. If we set up a log with segments but no marker, the
+previous process never closed it cleanly and we have to recover the segments.
+*/
+const cleanShutdownFile = "clean_shutdown"
+
 /*
 The log consists of a list of segments and a pointer to the active segment to
 append writes to. The directory is where we store the segments.
@@ -25,6 +34,73 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+	recovery      *Recovery
+
+	// unsynced counts the appends since the last sync, and syncErr holds
+	// the error from a failed background sync until the next append
+	unsynced uint64
+	syncErr  error
+
+	// done stops the log's background goroutines, the syncer and the
+	// janitor, and wg waits for them to return
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// appended is closed and replaced every time records are appended, to
+	// wake the readers waiting for them
+	appended chan struct{}
+	// appendRate counts appends for Stats
+	appendRate *appendRate
+	// resets counts the times the log was reset, so that WaitForOffset can
+	// tell its offsets started over
+	resets uint64
+
+	// compacting serializes compactions, which run mostly outside mu, and
+	// unclean is set when one failed partway through swapping a segment's
+	// files, so that Close leaves the log to be recovered
+	compacting sync.Mutex
+	unclean    bool
+}
+
+/*
+unavailable(err error) returns an error from the log's files, like a failed
+write or sync, as an api.ErrUnavailable, so that clients see it as the log
+failing rather than their request. Errors that already have a status, like
+api.ErrCorruptRecord, pass through as they are.
+*/
+func unavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+		return err
+	}
+	return api.ErrUnavailable{Err: err}
+}
+
+/*
+outOfRange(off uint64) returns the error for reading an offset the log has no
+record at or after, with the log's current range. The caller must hold the
+lock.
+*/
+func (l *Log) outOfRange(off uint64) api.ErrOffsetOutOfRange {
+	return api.ErrOffsetOutOfRange{
+		Offset: off,
+		Low:    l.segments[0].baseOffset,
+		High:   l.activeSegment.nextOffset,
+	}
+}
+
+/*
+Recovery reports what the log repaired when it was set up after an unclean
+shutdown: how many segments had their index rebuilt, how many records those
+indexes hold, and how many bytes of partially written records were discarded
+from the end of the segments' stores.
+*/
+type Recovery struct {
+	Segments       int
+	Records        uint64
+	TruncatedBytes uint64
 }
 
 /*
@@ -38,6 +114,43 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.TimeIndexIntervalBytes == 0 {
+		c.Segment.TimeIndexIntervalBytes = 4096
+	}
+	if c.MaxRecordBytes == 0 {
+		c.MaxRecordBytes = c.Segment.MaxStoreBytes
+	}
+	if c.Durability.Mode == "" {
+		c.Durability.Mode = DurabilityNone
+	}
+	if c.Durability.Records == 0 {
+		c.Durability.Records = 100
+	}
+	if c.Durability.Interval == 0 {
+		c.Durability.Interval = time.Second
+	}
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = time.Minute
+	}
+	if c.Compaction.DeleteRetention == 0 {
+		c.Compaction.DeleteRetention = 24 * time.Hour
+	}
+	if c.Compression.Codec == "" {
+		c.Compression.Codec = CodecNone
+	}
+	if _, ok := codecIDs[c.Compression.Codec]; !ok {
+		return nil, fmt.Errorf(
+			"unknown compression codec: %q", c.Compression.Codec,
+		)
+	}
+	switch c.Durability.Mode {
+	case DurabilityNone, DurabilityEveryNRecords,
+		DurabilityInterval, DurabilityAlways:
+	default:
+		return nil, fmt.Errorf(
+			"unknown durability mode: %q", c.Durability.Mode,
+		)
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
@@ -53,41 +166,86 @@ bootstrapping the initial segment. We fetch the list of the segments on disk,
 parse and sort the base offsets (because we want our slice of segments to be
 in order from oldest to newest), and then create the segments with the
 newSegment() helper method, which creates a segment for the base offset you
-pass in.
+pass in. If the previous process didn't shut the log down cleanly, we then
+recover the segments before taking any writes.
 */
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	// a compaction the previous process didn't finish leaves its
+	// half-written segments behind
+	err := os.RemoveAll(path.Join(l.Dir, compactionDir))
 	if err != nil {
 		return err
 	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
-		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
-	}
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	baseOffsets, err := segmentBaseOffsets(l.Dir)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(path.Join(l.Dir, cleanShutdownFile))
+	clean := err == nil
+	for _, baseOffset := range baseOffsets {
+		if err = l.newSegment(baseOffset); err != nil {
+			return err
+		}
+	}
+	if clean {
+		err = os.Remove(path.Join(l.Dir, cleanShutdownFile))
+		if err != nil {
+			return err
+		}
+	} else if l.segments != nil {
+		if err = l.recover(); err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
 	}
 	if l.segments == nil {
 		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
 	}
+	l.done = make(chan struct{})
+	l.appended = make(chan struct{})
+	l.appendRate = newAppendRate(time.Now())
+	if l.Config.Durability.Mode == DurabilityInterval {
+		l.startSyncer()
+	}
+	if l.Config.Retention.Duration > 0 || l.Config.Retention.Bytes > 0 ||
+		l.Config.Compaction.Enabled {
+		l.startJanitor()
+	}
 	return nil
 }
 
+/*
+recover() rebuilds the index of every segment from its store and trims any
+partially written record off the end. Segments stay open after the log rolls
+to a new active segment, so after a crash every index file is still at its
+preallocated size, not just the active one's.
+*/
+func (l *Log) recover() error {
+	r := &Recovery{}
+	for _, s := range l.segments {
+		records, truncated, err := s.recover()
+		if err != nil {
+			return err
+		}
+		r.Segments++
+		r.Records += records
+		r.TruncatedBytes += truncated
+	}
+	l.recovery = r
+	return nil
+}
+
+/*
+Recovery() returns what the log repaired when it was set up, or nil if the
+log was shut down cleanly (or is new).
+*/
+func (l *Log) Recovery() *Recovery {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.recovery
+}
+
 /*
 Append(*api.Record) appends a record to the log. We append the record to the
 active segment. Afterward, if the segment is at its max size (per the max size
@@ -99,16 +257,352 @@ and make the locks per segment rather than across the whole log. (I haven’t
 done that here because I want to keep this code simple
 */
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	if err := l.checkSize(record); err != nil {
+		return 0, err
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.done == nil {
+		return 0, api.ErrLogClosed{}
+	}
+	if err := l.syncErr; err != nil {
+		l.syncErr = nil
+		return 0, unavailable(err)
+	}
+	if err := l.makeRoom(1); err != nil {
+		return 0, err
+	}
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
-		return 0, err
+		return 0, unavailable(err)
+	}
+	if err = l.commit(1); err != nil {
+		return 0, unavailable(err)
 	}
+	l.appendRate.add(time.Now(), 1)
+	l.notifyAppended()
 	if l.activeSegment.IsMaxed() {
 		err = l.newSegment(off + 1)
 	}
-	return off, err
+	return off, unavailable(err)
+}
+
+/*
+AppendBatch(records []*api.Record) appends the records to the log as one batch
+and returns the first record's offset; the records get consecutive offsets, so
+the last one's is the first's plus the number of records minus one. The batch
+is written to the store as a single frame, so it's appended atomically: after
+a crash, the log recovers either every record in it or none. A batch can't
+span segments, so if the active segment's index doesn't have room for the
+whole batch, we roll to a new segment before appending it. A batch too big
+for even an empty segment is an api.ErrRecordTooLarge, as is a batch with a
+record larger than the max record size, in which case we append none of it.
+*/
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	if len(records) == 0 {
+		return 0, fmt.Errorf("empty record batch")
+	}
+	for _, record := range records {
+		if err := l.checkSize(record); err != nil {
+			return 0, err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done == nil {
+		return 0, api.ErrLogClosed{}
+	}
+	if err := l.syncErr; err != nil {
+		l.syncErr = nil
+		return 0, unavailable(err)
+	}
+	if err := l.makeRoom(len(records)); err != nil {
+		return 0, err
+	}
+	off, err := l.activeSegment.AppendBatch(records)
+	if err != nil {
+		return 0, unavailable(err)
+	}
+	if err = l.commit(uint64(len(records))); err != nil {
+		return 0, unavailable(err)
+	}
+	l.appendRate.add(time.Now(), uint64(len(records)))
+	l.notifyAppended()
+	if l.activeSegment.IsMaxed() {
+		err = l.newSegment(off + uint64(len(records)))
+	}
+	return off, unavailable(err)
+}
+
+/*
+makeRoom(n int) makes sure the active segment's index has room for n more
+entries before we append, rolling to a new segment if it hasn't, so that the
+segment never fills its index partway through an append. If even an empty
+segment hasn't room, the records are an api.ErrRecordTooLarge. The caller must
+hold the write lock.
+*/
+func (l *Log) makeRoom(n int) error {
+	s := l.activeSegment
+	if !s.fits(n) && s.nextOffset > s.baseOffset {
+		if err := l.newSegment(s.nextOffset); err != nil {
+			return unavailable(err)
+		}
+	}
+	if !l.activeSegment.fits(n) {
+		return api.ErrRecordTooLarge{
+			Size: uint64(n),
+			Max:  l.Config.Segment.MaxIndexBytes / entWidth,
+			Unit: "records",
+		}
+	}
+	return nil
+}
+
+/*
+checkSize(record *api.Record) returns an api.ErrRecordTooLarge if the record
+is larger than the configured maximum. We measure the record without its
+offset and timestamp, which the log sets and which add a few bytes to what the
+store writes, so that a record has the same size whether a producer appends it
+or a snapshot restore or replicator appends it again with them already set.
+*/
+func (l *Log) checkSize(record *api.Record) error {
+	n := uint64(proto.Size(&api.Record{
+		Value: record.Value,
+		Key:   record.Key,
+		Term:  record.Term,
+		Type:  record.Type,
+	}))
+	if n > l.Config.MaxRecordBytes {
+		return api.ErrRecordTooLarge{
+			Size: n,
+			Max:  l.Config.MaxRecordBytes,
+			Unit: "bytes",
+		}
+	}
+	return nil
+}
+
+/*
+commit(n uint64) counts n newly appended records towards the durability
+policy and syncs the log if the policy says it's time to. The caller must hold
+the write lock.
+*/
+func (l *Log) commit(n uint64) error {
+	l.unsynced += n
+	switch l.Config.Durability.Mode {
+	case DurabilityAlways:
+		return l.sync()
+	case DurabilityEveryNRecords:
+		if l.unsynced >= l.Config.Durability.Records {
+			return l.sync()
+		}
+	}
+	return nil
+}
+
+/*
+notifyAppended() wakes every reader waiting in WaitForOffset by closing the
+appended channel, and gives later waiters a new one. The caller must hold the
+write lock.
+*/
+func (l *Log) notifyAppended() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+/*
+WaitForOffset(ctx context.Context, off uint64) blocks until the log has a
+record to read at the given offset, or the next one after it that compaction
+kept, so that a consumer that has caught up with the log can wait for new
+records instead of polling for them. Waiting costs nothing: the waiter sleeps
+on the appended channel until an append closes it. We take the channel before
+we try the read, so an append between the two still wakes us. It returns
+api.ErrOffsetOutOfRange right away for an offset below the log's lowest, since
+no append will ever make it readable, the context's error if it's done
+before the record arrives, and api.ErrLogClosed if the log closes first. If
+the log is reset while we wait, we return api.ErrOffsetOutOfRange too.
+*/
+func (l *Log) WaitForOffset(ctx context.Context, off uint64) error {
+	l.mu.RLock()
+	resets := l.resets
+	l.mu.RUnlock()
+	for {
+		l.mu.RLock()
+		if l.done == nil {
+			l.mu.RUnlock()
+			return api.ErrLogClosed{}
+		}
+		if off < l.segments[0].baseOffset || l.resets != resets {
+			err := l.outOfRange(off)
+			l.mu.RUnlock()
+			return err
+		}
+		appended, done := l.appended, l.done
+		l.mu.RUnlock()
+
+		_, err := l.Read(off)
+		if _, ok := err.(api.ErrLogClosed); ok {
+			return err
+		}
+		if !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return api.ErrLogClosed{}
+		case <-appended:
+		}
+	}
+}
+
+/*
+Durability() reports the guarantee the log gives a record once Append returns,
+per the configured durability mode.
+*/
+func (l *Log) Durability() api.Durability {
+	switch l.Config.Durability.Mode {
+	case DurabilityEveryNRecords:
+		return api.Durability_DURABILITY_EVERY_N_RECORDS
+	case DurabilityInterval:
+		return api.Durability_DURABILITY_INTERVAL
+	case DurabilityAlways:
+		return api.Durability_DURABILITY_ALWAYS
+	default:
+		return api.Durability_DURABILITY_NONE
+	}
+}
+
+/*
+sync() syncs every segment with records appended since the last sync. Records
+appended before the log rolled to a new segment may still be unsynced in older
+segments, so we can't just sync the active one. The caller must hold the write
+lock.
+*/
+func (l *Log) sync() error {
+	for _, s := range l.segments {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	l.unsynced = 0
+	return nil
+}
+
+/*
+startSyncer() starts the goroutine that implements DurabilityInterval: every
+interval it syncs whatever was appended since its last run, so all the records
+appended in that window get committed together by one sync. If a sync fails,
+the next append returns its error.
+*/
+func (l *Log) startSyncer() {
+	l.wg.Add(1)
+	go func(done chan struct{}) {
+		defer l.wg.Done()
+		ticker := time.NewTicker(l.Config.Durability.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				l.mu.Lock()
+				if l.unsynced > 0 {
+					if err := l.sync(); err != nil {
+						l.syncErr = err
+					}
+				}
+				l.mu.Unlock()
+			}
+		}
+	}(l.done)
+}
+
+/*
+startJanitor() starts the goroutine that enforces the retention policy and,
+if it's enabled, compacts the log every check interval. There's no caller to
+hand an error to, so a failed run is simply retried on the next tick.
+*/
+func (l *Log) startJanitor() {
+	l.wg.Add(1)
+	go func(done chan struct{}) {
+		defer l.wg.Done()
+		ticker := time.NewTicker(l.Config.Retention.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = l.enforceRetention()
+				if l.Config.Compaction.Enabled {
+					_ = l.Compact()
+				}
+			}
+		}
+	}(l.done)
+}
+
+/*
+stopBackground() stops the log's background goroutines and waits for them to
+return. We call it before taking the write lock on close, since they need
+that lock to finish their current run; closing done also wakes the readers
+waiting for appends. We only take the lock to clear done once they've returned.
+*/
+func (l *Log) stopBackground() {
+	l.mu.RLock()
+	done := l.done
+	l.mu.RUnlock()
+	if done == nil {
+		return
+	}
+	close(done)
+	l.wg.Wait()
+	l.mu.Lock()
+	l.done = nil
+	l.mu.Unlock()
+}
+
+/*
+enforceRetention() deletes the segments the retention policy no longer keeps.
+First, if the active segment has outlived its max age without an append to
+roll it, we roll it so that its records can expire too. Then, from the oldest
+segment on, we delete segments whose newest record is older than the
+retention duration and segments that put the log over its retention bytes. We
+only ever delete from the front of the log so its offsets stay contiguous, and
+we never delete the active segment.
+*/
+func (l *Log) enforceRetention() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	active := l.activeSegment
+	if active.IsMaxed() && active.nextOffset > active.baseOffset {
+		if err := l.newSegment(active.nextOffset); err != nil {
+			return err
+		}
+	}
+	var total uint64
+	for _, s := range l.segments {
+		total += s.size()
+	}
+	deadline := time.Now().Add(-l.Config.Retention.Duration)
+	maxBytes := l.Config.Retention.Bytes
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		expired := l.Config.Retention.Duration > 0 &&
+			s.modified.Before(deadline)
+		oversize := maxBytes > 0 && total > maxBytes
+		if !expired && !oversize {
+			break
+		}
+		total -= s.size()
+		if err := s.retire(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
 }
 
 /*
@@ -119,30 +613,72 @@ smallest offset in the segment, we iterate over the segments until we find the
 first segment whose base offset is less than or equal to the offset we’re looking
 for. Once we know the segment that contains the record, we get the index
 entry from the segment’s index, and we read the data out of the segment’s
-store file and return the data to the caller.
+store file and return the data to the caller. If compaction removed the
+record, we return the next record that survived instead, which may be in a
+later segment; since compaction can remove every record at the end of a
+segment, or whole segments, the offset can also fall in a gap between two
+segments, in which case we read from the start of the later one.
 */
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
+	if l.done == nil {
+		return nil, api.ErrLogClosed{}
+	}
+	if off < l.segments[0].baseOffset {
+		return nil, l.outOfRange(off)
+	}
+	next := off
+	for _, s := range l.segments {
+		if s.nextOffset <= next {
+			continue
+		}
+		if next < s.baseOffset {
+			next = s.baseOffset
 		}
+		record, err := s.Read(next)
+		if err == io.EOF {
+			continue
+		}
+		return record, unavailable(err)
 	}
-	// START: after
-	if s == nil || s.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	return nil, l.outOfRange(off)
+}
+
+/*
+OffsetForTime(t time.Time) returns the offset of the first record timestamped
+at or after t, so a consumer can replay everything since a point in time. We
+ask each segment from the oldest on, and the first one with a record at or
+after t has our answer. If no record is that recent yet, we return the offset
+the next appended record will get, so the consumer picks up from there.
+*/
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.done == nil {
+		return 0, api.ErrLogClosed{}
+	}
+	ts := t.UnixNano()
+	for _, s := range l.segments {
+		off, ok, err := s.OffsetForTime(ts)
+		if err != nil {
+			return 0, unavailable(err)
+		}
+		if ok {
+			return off, nil
+		}
 	}
-	// END: after
-	return s.Read(off)
+	return l.activeSegment.nextOffset, nil
 }
 
 /*
-Iterates over the segments and closes them.
+Iterates over the segments and closes them. Once every segment has closed,
+we write the clean shutdown marker so the next setup can trust the indexes,
+unless a compaction left them in doubt. From then on, appending to or reading
+from the log returns api.ErrLogClosed.
 */
 func (l *Log) Close() error {
+	l.stopBackground()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	for _, segment := range l.segments {
@@ -150,7 +686,14 @@ func (l *Log) Close() error {
 			return err
 		}
 	}
-	return nil
+	if l.unclean {
+		return nil
+	}
+	f, err := os.Create(path.Join(l.Dir, cleanShutdownFile))
+	if err != nil {
+		return err
+	}
+	return f.Close()
 }
 
 /*
@@ -164,13 +707,46 @@ func (l *Log) Remove() error {
 }
 
 /*
-Removes the log and then creates a new log to replace it.
+Reset() empties the log and starts it over from its initial offset. The log
+stays open: we evict every segment, removing its files, and create a new
+active segment. Readers still reading an evicted segment's store finish
+reading it first. Since the offsets start over, we wake the consumers waiting
+for records, and WaitForOffset tells them their offset is out of range rather
+than have them wait for an offset that now means a different record.
 */
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
-		return err
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reset()
+}
+
+/*
+resetTo(off uint64) resets the log to start over at the given offset, which
+becomes the log's initial offset.
+*/
+func (l *Log) resetTo(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Config.Segment.InitialOffset = off
+	return l.reset()
+}
+
+/*
+reset() is Reset() for a caller that holds the write lock.
+*/
+func (l *Log) reset() error {
+	if l.done == nil {
+		return api.ErrLogClosed{}
 	}
-	return l.setup()
+	for _, s := range l.segments {
+		if err := s.evict(); err != nil {
+			return unavailable(err)
+		}
+	}
+	l.segments = nil
+	l.resets++
+	l.notifyAppended()
+	return unavailable(l.newSegment(l.Config.Segment.InitialOffset))
 }
 
 /*
@@ -199,15 +775,22 @@ func (l *Log) HighestOffset() (uint64, error) {
 Truncate(lowest uint64) removes all segments whose highest offset is lower than
 lowest. Because we don’t have disks with infinite space, we’ll periodically call
 Truncate() to remove old segments whose data we (hopefully) have processed
-by then and don’t need anymore.
+by then and don’t need anymore. Like the retention janitor, we retire the
+segments so that readers still reading them finish first. We never remove the
+active segment, which takes the appends, so the log always has one. A
+consumer whose offset was in a removed segment gets api.ErrOffsetOutOfRange,
+with the log's new lowest offset to carry on from.
 */
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.done == nil {
+		return api.ErrLogClosed{}
+	}
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
+		if s.nextOffset <= lowest+1 && s != l.activeSegment {
+			if err := s.retire(); err != nil {
 				return err
 			}
 			continue
@@ -219,37 +802,123 @@ func (l *Log) Truncate(lowest uint64) error {
 }
 
 /*
-Reader() returns an io.Reader to read the whole log. We’ll need this capability
+Roll() closes the active segment to appends and makes a new one active, as
+the log does when the active segment is full or too old, and returns the new
+segment's base offset. An empty active segment has nothing to close off and
+its successor would have the same base offset, so we leave it be.
+*/
+func (l *Log) Roll() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done == nil {
+		return 0, api.ErrLogClosed{}
+	}
+	s := l.activeSegment
+	if s.nextOffset == s.baseOffset {
+		return s.baseOffset, nil
+	}
+	if err := l.newSegment(s.nextOffset); err != nil {
+		return 0, unavailable(err)
+	}
+	return l.activeSegment.baseOffset, nil
+}
+
+/*
+Reader() returns an io.ReadCloser to read the whole log. We’ll need this capability
 when we implement coordinate consensus and need to support snapshots
 and restoring a log. Reader() uses an io.MultiReader() call to concatenate the segments’ stores.
 The segment stores are wrapped by the originReader type for tw reasons.
  The first reason is to satisfy the io.Reader interface so we can pass it
 into the io.MultiReader() call. The second is to ensure that we begin reading from
-the origin of the store and read its entire file.
+the origin of the store and read its entire file. Each originReader holds
+its segment until it has read the whole store, so truncation and retention
+leave the segment's files alone until then. The reader reads the log as it
+was when we created it: each store up to its size then, so records appended
+while it reads don't show up. Closing the reader releases the segments it
+hasn't finished reading, for a caller that stops before the end.
 */
-func (l *Log) Reader() io.Reader {
+func (l *Log) Reader() io.ReadCloser {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	r := &logReader{origins: make([]*originReader, len(l.segments))}
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		segment.acquire()
+		r.origins[i] = &originReader{
+			store:   segment.store,
+			segment: segment,
+			size:    int64(segment.store.size),
+		}
+		readers[i] = r.origins[i]
 	}
-	return io.MultiReader(readers...)
+	r.Reader = io.MultiReader(readers...)
+	return r
 }
 
-type originReader struct {
-	*store
-	off int64
+type logReader struct {
+	io.Reader
+	origins []*originReader
+}
+
+func (r *logReader) Close() error {
+	var err error
+	for _, o := range r.origins {
+		if rerr := o.release(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
 }
 
 /*
+originReader holds its store in a named field rather than embedding it, since
+the store's embedded file would promote its WriteTo method, and io.Copy would
+then copy from wherever the file's write offset is instead of calling Read.
+*/
+type originReader struct {
+	store   *store
+	segment *segment
+	off     int64
+	size    int64
+}
 
- */
+/*
+Read(p []byte) reads the store from where the last read left off, up to the
+size the store had when we created the reader. Once the store runs out or
+fails, we release the segment.
+*/
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
+	if o.off >= o.size {
+		return 0, o.releaseWith(io.EOF)
+	}
+	if rest := o.size - o.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := o.store.ReadAt(p, o.off)
 	o.off += int64(n)
+	if err != nil {
+		err = o.releaseWith(err)
+	}
 	return n, err
+}
+
+func (o *originReader) releaseWith(err error) error {
+	if rerr := o.release(); rerr != nil {
+		return rerr
+	}
+	return err
+}
 
+/*
+release() releases the segment, once, however often we're called.
+*/
+func (o *originReader) release() error {
+	if o.segment == nil {
+		return nil
+	}
+	err := o.segment.release()
+	o.segment = nil
+	return err
 }
 
 /*
@@ -1,13 +1,22 @@
 package log
 
 import (
+	"context"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	api "github.com/SStoyanov22/proglog/api/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 /*
@@ -24,6 +33,15 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"recover after unclean shutdown":    testRecover,
+		"offset for time":                   testOffsetForTime,
+		"compaction":                        testCompaction,
+		"compaction alongside appends":      testCompactionConcurrent,
+		"append batch":                      testAppendBatch,
+		"wait for offset":                   testWaitForOffset,
+		"max record size":                   testMaxRecordBytes,
+		"offsets and stats":                 testOffsetsAndStats,
+		"roll and reset":                    testRollAndReset,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -40,6 +58,384 @@ func TestLog(t *testing.T) {
 	}
 }
 
+/*
+TestDurability(*testing.T) tests that each durability mode syncs appended
+records to the store's file when it promises to, by checking the file's size
+on disk instead of reading through the store, which would flush its buffer.
+*/
+func TestDurability(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		mode       DurabilityMode
+		synced     []bool
+		eventually bool
+	}{
+		"none":            {mode: DurabilityNone, synced: []bool{false, false, false}},
+		"every n records": {mode: DurabilityEveryNRecords, synced: []bool{false, true, false}},
+		"always":          {mode: DurabilityAlways, synced: []bool{true, true, true}},
+		"interval":        {mode: DurabilityInterval, eventually: true},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "durability-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Durability.Mode = tc.mode
+			c.Durability.Records = 2
+			c.Durability.Interval = 10 * time.Millisecond
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			var size int64
+			synced := func() bool {
+				fi, err := os.Stat(log.activeSegment.store.Name())
+				require.NoError(t, err)
+				grew := fi.Size() > size
+				size = fi.Size()
+				return grew
+			}
+			append := &api.Record{Value: []byte("hello world")}
+			for _, want := range tc.synced {
+				_, err = log.Append(append)
+				require.NoError(t, err)
+				require.Equal(t, want, synced())
+			}
+			if tc.eventually {
+				_, err = log.Append(append)
+				require.NoError(t, err)
+				require.Eventually(t, synced, time.Second, 10*time.Millisecond)
+			}
+		})
+	}
+
+	c := Config{}
+	c.Durability.Mode = "sometimes"
+	_, err := NewLog(os.TempDir(), c)
+	require.Error(t, err)
+}
+
+/*
+TestIndexCapacity(*testing.T) tests that with the default max index bytes,
+which aren't a multiple of an entry's width, the log rolls to a new segment
+when the index has no room for another entry rather than failing the append,
+and that recovering a segment discards a frame its full index had no entry
+for, which a failed append used to leave in the store.
+*/
+func TestIndexCapacity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-capacity-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	perIndex := log.Config.Segment.MaxIndexBytes / entWidth
+	append := &api.Record{Value: []byte("hello world")}
+	for i := uint64(0); i < perIndex+10; i++ {
+		off, err := log.Append(append)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, perIndex, log.activeSegment.baseOffset)
+
+	p, err := proto.Marshal(&api.Record{Offset: perIndex, Value: append.Value})
+	require.NoError(t, err)
+	orphan, err := log.segments[0].appendFrame(p, 0)
+	require.NoError(t, err)
+	size := log.segments[0].store.size
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(path.Join(dir, cleanShutdownFile)))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, &Recovery{
+		Segments:       2,
+		Records:        perIndex + 10,
+		TruncatedBytes: size - orphan,
+	}, log.Recovery())
+	for i := uint64(0); i < perIndex+10; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, perIndex+10, off)
+}
+
+/*
+TestRetention(*testing.T) tests that the log rolls segments by age and that
+its retention policy deletes old segments, but not while a reader is still
+reading them.
+*/
+func TestRetention(t *testing.T) {
+	append := &api.Record{Value: []byte("hello world")}
+	newLog := func(t *testing.T, c Config) *Log {
+		dir, err := ioutil.TempDir("", "retention-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		return log
+	}
+	segments := func(log *Log) int {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return len(log.segments)
+	}
+
+	t.Run("max age rolls the active segment", func(t *testing.T) {
+		c := Config{}
+		c.Segment.MaxAge = 10 * time.Millisecond
+		log := newLog(t, c)
+		_, err := log.Append(append)
+		require.NoError(t, err)
+		require.Equal(t, 1, segments(log))
+		time.Sleep(2 * c.Segment.MaxAge)
+		_, err = log.Append(append)
+		require.NoError(t, err)
+		require.Equal(t, 2, segments(log))
+	})
+
+	t.Run("duration deletes old segments", func(t *testing.T) {
+		c := Config{}
+		c.Segment.MaxStoreBytes = 64
+		c.Retention.Duration = 10 * time.Millisecond
+		c.Retention.CheckInterval = time.Hour
+		log := newLog(t, c)
+		for i := 0; i < 4; i++ {
+			_, err := log.Append(append)
+			require.NoError(t, err)
+		}
+		require.Equal(t, 3, segments(log))
+		time.Sleep(2 * c.Retention.Duration)
+		_, err := log.Append(append)
+		require.NoError(t, err)
+
+		require.NoError(t, log.enforceRetention())
+		require.Equal(t, 1, segments(log))
+		off, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), off)
+		_, err = log.Read(3)
+		require.Error(t, err)
+	})
+
+	t.Run("producer timestamps don't age segments", func(t *testing.T) {
+		c := Config{}
+		c.Segment.MaxStoreBytes = 64
+		c.Retention.Duration = time.Hour
+		c.Retention.CheckInterval = time.Hour
+		log := newLog(t, c)
+		old := timestamppb.New(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+		for i := 0; i < 4; i++ {
+			_, err := log.Append(&api.Record{Value: append.Value, Timestamp: old})
+			require.NoError(t, err)
+		}
+		modified := log.segments[0].modified
+		require.NoError(t, log.Close())
+
+		log, err := NewLog(log.Dir, c)
+		require.NoError(t, err)
+		defer log.Close()
+		require.WithinDuration(t, modified, log.segments[0].modified, time.Millisecond)
+		require.NoError(t, log.enforceRetention())
+		require.Equal(t, 3, segments(log))
+	})
+
+	t.Run("bytes deletes the oldest segments", func(t *testing.T) {
+		c := Config{}
+		c.Segment.MaxStoreBytes = 64
+		c.Retention.CheckInterval = time.Hour
+		log := newLog(t, c)
+		for i := 0; i < 6; i++ {
+			_, err := log.Append(append)
+			require.NoError(t, err)
+		}
+		require.Equal(t, 4, segments(log))
+		log.Config.Retention.Bytes = 2*log.segments[0].size() + 1
+
+		require.NoError(t, log.enforceRetention())
+		require.Equal(t, 2, segments(log))
+		off, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), off)
+	})
+
+	t.Run("janitor waits for readers", func(t *testing.T) {
+		c := Config{}
+		c.Segment.MaxStoreBytes = 64
+		c.Segment.MaxAge = 10 * time.Millisecond
+		c.Retention.Duration = 10 * time.Millisecond
+		c.Retention.CheckInterval = 10 * time.Millisecond
+		log := newLog(t, c)
+		defer log.Close()
+		for i := 0; i < 2; i++ {
+			_, err := log.Append(append)
+			require.NoError(t, err)
+		}
+		oldest := log.segments[0].store.Name()
+		reader := log.Reader()
+
+		require.Eventually(t, func() bool {
+			off, err := log.LowestOffset()
+			require.NoError(t, err)
+			return off == 2
+		}, time.Second, 10*time.Millisecond)
+		_, err := os.Stat(oldest)
+		require.NoError(t, err)
+
+		b, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.NotEmpty(t, b)
+		_, err = os.Stat(oldest)
+		require.True(t, os.IsNotExist(err))
+	})
+}
+
+/*
+TestCompression(*testing.T) tests that each codec shrinks a batch of verbose
+records in the store and reads them back, and that a log reopened with a
+different codec still reads the frames the old one wrote.
+*/
+func TestCompression(t *testing.T) {
+	value := []byte(strings.Repeat(`{"event":"page_view","path":"/index.html"}`, 8))
+	batch := func() []*api.Record {
+		records := make([]*api.Record, 10)
+		for i := range records {
+			records[i] = &api.Record{Value: value}
+		}
+		return records
+	}
+	var uncompressed uint64
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecSnappy, CodecZstd} {
+		t.Run(string(codec), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "compression-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Compression.Codec = codec
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			_, err = log.AppendBatch(batch())
+			require.NoError(t, err)
+			_, err = log.Append(&api.Record{Value: value})
+			require.NoError(t, err)
+			size := log.activeSegment.store.size
+			if codec == CodecNone {
+				uncompressed = size
+			} else {
+				require.Less(t, size, uncompressed/2)
+			}
+			require.NoError(t, log.Close())
+
+			c.Compression.Codec = CodecNone
+			if codec == CodecNone {
+				c.Compression.Codec = CodecZstd
+			}
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			_, err = log.Append(&api.Record{Value: value})
+			require.NoError(t, err)
+			for off := uint64(0); off < 12; off++ {
+				read, err := log.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, read.Offset)
+				require.Equal(t, value, read.Value)
+			}
+		})
+	}
+
+	dir, err := ioutil.TempDir("", "compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Compression.Codec = "lz4"
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
+
+/*
+TestEncryption(*testing.T) tests that a log with a key provider doesn't write
+its records to the store in plaintext, that after rotating the key it still
+reads the frames the old key encrypted along with those from before it had
+encryption on, and that it can't read them without the keys.
+*/
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyDir, err := ioutil.TempDir("", "encryption-test-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyDir)
+	writeKey := func(id int, key string) {
+		name := path.Join(keyDir, fmt.Sprintf("%d.key", id))
+		require.NoError(t, ioutil.WriteFile(name, []byte(hex.EncodeToString([]byte(key))), 0600))
+	}
+	value := []byte("sensitive value")
+	read := func(log *Log) {
+		for off := uint64(0); off < 4; off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, value, record.Value)
+		}
+	}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	writeKey(1, "0123456789abcdef")
+	kp, err := NewFileKeyProvider(keyDir)
+	require.NoError(t, err)
+	c.Encryption.KeyProvider = kp
+	c.Compression.Codec = CodecGzip
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.AppendBatch([]*api.Record{{Value: value}, {Value: value}})
+	require.NoError(t, err)
+
+	writeKey(2, "fedcba9876543210fedcba9876543210")
+	require.NoError(t, kp.Reload())
+	id, _, err := kp.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), id)
+	_, err = log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+	read(log)
+	require.NoError(t, log.Close())
+
+	b, err := ioutil.ReadFile(log.activeSegment.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(b), string(value)))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	read(log)
+	require.NoError(t, log.Close())
+
+	c.Encryption.KeyProvider = nil
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	_, err = log.Read(1)
+	require.Error(t, err)
+	require.NoError(t, log.Close())
+}
+
 /*
 testAppendRead(*testing.T, *log.Log) tests that we can successfully append to and
 read from the log. When we append a record to the log, the log returns the
@@ -61,13 +457,30 @@ func testAppendRead(t *testing.T, log *Log) {
 
 /*
 testOutOfRangeErr(*testing.T, *log.Log) tests that the log returns an error when we
-try to read an offset that’s outside of the range of offsets the log has stored.
+try to read an offset that’s outside of the range of offsets the log has stored,
+with the log's range in it and in its status's details.
 */
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
 	apiErr := err.(api.ErrOffsetOutOfRange)
 	require.Equal(t, uint64(1), apiErr.Offset)
+	require.Equal(t, uint64(0), apiErr.Low)
+	require.Equal(t, uint64(0), apiErr.High)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.Read(5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5, Low: 0, High: 1}, err)
+	st := err.(api.ErrOffsetOutOfRange).GRPCStatus()
+	require.Equal(t, codes.OutOfRange, st.Code())
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "OFFSET_OUT_OF_RANGE", info.Reason)
+	require.Equal(t, map[string]string{
+		"offset":      "5",
+		"low_offset":  "0",
+		"high_offset": "1",
+	}, info.Metadata)
 }
 
 /*
@@ -98,6 +511,8 @@ func testInitExisting(t *testing.T, o *Log) {
 	n, err := NewLog(o.Dir, o.Config)
 	require.NoError(t, err)
 
+	require.Nil(t, n.Recovery())
+
 	off, err = n.LowestOffset()
 	require.NoError(t, err)
 	require.Equal(t, uint64(0), off)
@@ -106,6 +521,439 @@ func testInitExisting(t *testing.T, o *Log) {
 	require.Equal(t, uint64(2), off)
 }
 
+/*
+testRecover(*testing.T, *log.Log) tests that a log that was never closed, with a
+record only partially written at the end of its active segment's store, comes
+back with rebuilt indexes, the partial record discarded, and a report of what
+was recovered.
+*/
+func testRecover(t *testing.T, o *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(append)
+		require.NoError(t, err)
+	}
+	// reading flushes the stores' buffers to their files, like the OS would
+	// have before the process died
+	for i := uint64(0); i < 3; i++ {
+		_, err := o.Read(i)
+		require.NoError(t, err)
+	}
+
+	f, err := os.OpenFile(o.activeSegment.store.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	torn := make([]byte, lenWidth+crcWidth+5)
+	enc.PutUint64(torn, frameHeader(frameVersion, 0, 100))
+	_, err = f.Write(torn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Equal(t, &Recovery{
+		Segments:       len(n.segments),
+		Records:        3,
+		TruncatedBytes: uint64(len(torn)),
+	}, n.Recovery())
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	for i := uint64(0); i < 3; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, append.Value, read.Value)
+	}
+	off, err = n.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, n.Close())
+
+	n, err = NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Nil(t, n.Recovery())
+}
+
+/*
+testAppendBatch(*testing.T, *log.Log) tests that a batch's records get
+consecutive offsets and read back one by one, that the log rolls rather than
+split a batch across segments, and that a batch torn by a crash is discarded
+whole when the log recovers.
+*/
+func testAppendBatch(t *testing.T, o *Log) {
+	_, err := o.Append(&api.Record{Value: []byte("single")})
+	require.NoError(t, err)
+
+	batch := func(n int) []*api.Record {
+		records := make([]*api.Record, n)
+		for i := range records {
+			records[i] = &api.Record{Value: []byte(fmt.Sprintf("batch %d", i))}
+		}
+		return records
+	}
+	off, err := o.AppendBatch(batch(3))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	for i := uint64(0); i < 3; i++ {
+		read, err := o.Read(off + i)
+		require.NoError(t, err)
+		require.Equal(t, off+i, read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("batch %d", i)), read.Value)
+		require.NotNil(t, read.Timestamp)
+	}
+
+	_, err = o.AppendBatch(nil)
+	require.Error(t, err)
+	_, err = o.AppendBatch(batch(int(o.Config.Segment.MaxIndexBytes/entWidth) + 1))
+	require.IsType(t, api.ErrRecordTooLarge{}, err)
+
+	dir, err := ioutil.TempDir("", "batch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// the active segment only has room for three more records, so the log
+	// rolls before appending a batch of four
+	_, err = l.Append(&api.Record{Value: []byte("single")})
+	require.NoError(t, err)
+	off, err = l.AppendBatch(batch(4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, 3, len(l.segments))
+	require.Equal(t, off, l.segments[1].baseOffset)
+
+	_, err = l.AppendBatch(batch(3))
+	require.NoError(t, err)
+	// reading flushes the store's buffer to its file, like the OS would have
+	// before the process died
+	_, err = l.Read(5)
+	require.NoError(t, err)
+	store := l.activeSegment.store
+	require.NoError(t, os.Truncate(store.Name(), int64(store.size-1)))
+
+	n, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, store.size-1, n.Recovery().TruncatedBytes)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	_, err = n.Read(5)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+/*
+testMaxRecordBytes(*testing.T, *log.Log) tests that the log rejects a record
+larger than the max record size, which defaults to the max store size, alone
+or in a batch, without appending any of the batch.
+*/
+func testMaxRecordBytes(t *testing.T, o *Log) {
+	require.Equal(t, o.Config.Segment.MaxStoreBytes, o.Config.MaxRecordBytes)
+	large := &api.Record{Value: make([]byte, o.Config.MaxRecordBytes)}
+	_, err := o.Append(large)
+	require.Equal(t, api.ErrRecordTooLarge{
+		Size: uint64(proto.Size(large)),
+		Max:  o.Config.MaxRecordBytes,
+		Unit: "bytes",
+	}, err)
+
+	_, err = o.AppendBatch([]*api.Record{{Value: []byte("small")}, large})
+	require.IsType(t, api.ErrRecordTooLarge{}, err)
+	_, err = o.Read(0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	off, err := o.Append(&api.Record{Value: []byte("small")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+/*
+testOffsetsAndStats(*testing.T, *log.Log) tests that the log's range and
+stats follow appends across segments, and that a truncated log's range starts
+at its new lowest offset.
+*/
+func testOffsetsAndStats(t *testing.T, o *Log) {
+	low, high, err := o.Offsets()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), low)
+	require.Equal(t, uint64(0), high)
+
+	for i := 0; i < 3; i++ {
+		_, err = o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	low, high, err = o.Offsets()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), low)
+	require.Equal(t, uint64(3), high)
+
+	stats, err := o.Stats()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), stats.LowOffset)
+	require.Equal(t, uint64(3), stats.HighOffset)
+	require.Equal(t, uint64(len(o.segments)), stats.Segments)
+	var bytes uint64
+	for _, s := range o.segments {
+		bytes += s.size()
+	}
+	require.Equal(t, bytes, stats.Bytes)
+	require.Greater(t, stats.AppendRate, 0.0)
+
+	require.NoError(t, o.Truncate(1))
+	low, _, err = o.Offsets()
+	require.NoError(t, err)
+	require.Equal(t, o.segments[0].baseOffset, low)
+	require.NotZero(t, low)
+}
+
+/*
+testRollAndReset(*testing.T, *log.Log) tests rolling the active segment,
+that truncating never removes the active segment, and that resetting the log
+starts it over while a reader of the old log finishes reading it and a
+consumer waiting for a record is told its offset is out of range.
+*/
+func testRollAndReset(t *testing.T, o *Log) {
+	base, err := o.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), base)
+	_, err = o.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	base, err = o.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), base)
+	segments, err := o.Segments()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, uint64(1), segments[0].Records)
+	require.Equal(t, uint64(1), segments[1].BaseOffset)
+
+	require.NoError(t, o.Truncate(100))
+	require.Equal(t, 1, len(o.segments))
+	require.Equal(t, o.activeSegment, o.segments[0])
+
+	_, err = o.Append(&api.Record{Value: []byte("world")})
+	require.NoError(t, err)
+	reader := o.Reader()
+	waited := make(chan error)
+	go func() {
+		waited <- o.WaitForOffset(context.Background(), 2)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, o.Reset())
+	require.IsType(t, api.ErrOffsetOutOfRange{}, <-waited)
+
+	b, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NotEmpty(t, b)
+	_, err = o.Read(1)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	off, err := o.Append(&api.Record{Value: []byte("again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	// only the new segments' files and the clean shutdown marker are left
+	segments, err = o.Segments()
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+	files, err := ioutil.ReadDir(o.Dir)
+	require.NoError(t, err)
+	require.Equal(t, 3*len(segments)+1, len(files))
+}
+
+/*
+testWaitForOffset(*testing.T, *log.Log) tests that waiting for an offset
+returns once a record with that offset is appended, and not before, and that
+it stops waiting when its context is done or the log closes.
+*/
+func testWaitForOffset(t *testing.T, o *Log) {
+	ctx := context.Background()
+	_, err := o.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, o.WaitForOffset(ctx, 0))
+
+	waited := make(chan error)
+	go func() {
+		waited <- o.WaitForOffset(ctx, 2)
+	}()
+	_, err = o.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	select {
+	case err = <-waited:
+		t.Fatalf("waiting for offset 2 returned after offset 1: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = o.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, <-waited)
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, o.WaitForOffset(timeout, 3))
+
+	go func() {
+		waited <- o.WaitForOffset(ctx, 3)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, o.Close())
+	require.Equal(t, api.ErrLogClosed{}, <-waited)
+	require.Equal(t, api.ErrLogClosed{}, o.WaitForOffset(ctx, 0))
+	_, err = o.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrLogClosed{}, err)
+	_, err = o.Read(0)
+	require.Equal(t, api.ErrLogClosed{}, err)
+}
+
+/*
+testOffsetForTime(*testing.T, *log.Log) tests that we can find the first record
+at or after a timestamp across segments, including when a producer set a
+timestamp earlier than the records before it, and that the log finds the same
+offsets after it's reopened.
+*/
+func testOffsetForTime(t *testing.T, o *Log) {
+	start := time.Now().Add(-time.Hour)
+	for _, minute := range []int{0, 1, 2, 1, 3} {
+		_, err := o.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: timestamppb.New(start.Add(time.Duration(minute) * time.Minute)),
+		})
+		require.NoError(t, err)
+	}
+	check := func(l *Log) {
+		for after, want := range map[time.Duration]uint64{
+			-time.Minute:     0,
+			0:                0,
+			30 * time.Second: 1,
+			90 * time.Second: 2,
+			3 * time.Minute:  4,
+			time.Hour:        5,
+		} {
+			off, err := l.OffsetForTime(start.Add(after))
+			require.NoError(t, err)
+			require.Equal(t, want, off, after)
+		}
+	}
+	check(o)
+	require.NoError(t, o.Close())
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	check(n)
+}
+
+/*
+testCompaction(*testing.T, *log.Log) tests that compaction keeps only the latest
+record for each key, keeps records without a key, keeps tombstones until their
+delete retention passes, and that reading an offset that was compacted away
+returns the next record that survived, both before and after the log is
+reopened.
+*/
+func testCompaction(t *testing.T, o *Log) {
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("first a")},
+		{Key: []byte("b"), Value: []byte("first b")},
+		{Value: []byte("no key")},
+		{Key: []byte("a"), Value: []byte("second a")},
+		{Key: []byte("b")},
+		{Key: []byte("c"), Value: []byte("first c")},
+		{Key: []byte("a"), Value: []byte("third a")},
+	}
+	for _, record := range records {
+		_, err := o.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Compact())
+
+	check := func(l *Log, reads map[uint64]uint64) {
+		for off, want := range reads {
+			read, err := l.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, want, read.Offset)
+			require.Equal(t, records[want].Value, read.Value)
+		}
+		off, err := l.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+	// the first a, the first b, and the second a were compacted away
+	reads := map[uint64]uint64{0: 2, 1: 2, 2: 2, 3: 4, 4: 4, 5: 5, 6: 6}
+	check(o, reads)
+	require.NoError(t, o.Close())
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	check(n, reads)
+
+	// once its delete retention passes, b's tombstone goes too
+	n.Config.Compaction.DeleteRetention = time.Nanosecond
+	require.NoError(t, n.Compact())
+	reads[3], reads[4] = 5, 5
+	check(n, reads)
+
+	_, err = n.Read(7)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+/*
+testCompactionConcurrent(*testing.T, *log.Log) tests that the log takes
+appends and reads while it compacts, and that compaction keeps the latest
+record for each key of those appended meanwhile.
+*/
+func testCompactionConcurrent(t *testing.T, o *Log) {
+	const keys, n = 5, 200
+	done := make(chan error)
+	go func() {
+		for i := 0; i < n; i++ {
+			record := &api.Record{
+				Key:   []byte(fmt.Sprintf("%d", i%keys)),
+				Value: []byte(fmt.Sprintf("%d", i)),
+			}
+			if _, err := o.Append(record); err != nil {
+				done <- err
+				return
+			}
+			if _, err := o.Read(uint64(i)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for appending := true; appending; {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			appending = false
+		default:
+			require.NoError(t, o.Compact())
+		}
+	}
+	require.NoError(t, o.Compact())
+
+	var survivors int
+	for off := uint64(0); ; {
+		record, err := o.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		}
+		require.NoError(t, err)
+		survivors++
+		off = record.Offset + 1
+	}
+	// the active segment isn't compacted, so it may hold a stale record or two
+	require.LessOrEqual(t, survivors, keys+2)
+	for i := n - keys; i < n; i++ {
+		record, err := o.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("%d", i)), record.Value)
+	}
+	require.NoError(t, o.Close())
+	require.Equal(t, api.ErrLogClosed{}, o.Compact())
+}
+
 /*
 testReader(*testing.T, *log.Log) tests that we can read the full, raw log as it’s stored
 on disk so that we can snapshot and restore the logs in Finite-State Machine.
@@ -123,7 +971,7 @@ func testReader(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[lenWidth+crcWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 }
@@ -0,0 +1,260 @@
+package log
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Replicator copies the records of the servers in the cluster into the local
+log. It's a discovery.Handler: when a server joins, we dial it, consume its
+log from the beginning with ConsumeStream, and append each record we get to
+ours, in a goroutine of its own for each server, until the server leaves or
+we close. The records get the local log's offsets, since the local log has
+records of its own and of the other servers too. We remember where we got to
+in each server's log after it leaves, so that if it joins again we carry on
+from there rather than copy its records a second time.
+*/
+type Replicator struct {
+	// DialOptions configure the connections to the other servers, like
+	// the credentials to dial them with.
+	DialOptions []grpc.DialOption
+	// LocalLog is the log we append the records we replicate to.
+	LocalLog *Log
+	// Logger logs the errors replicating from a server. Nil logs nothing.
+	Logger *zap.Logger
+
+	logger *zap.Logger
+
+	mu sync.Mutex
+	// servers maps each server we've replicated from to where we are in its
+	// log, including the ones that left
+	servers map[string]*replica
+	closed  bool
+	close   chan struct{}
+	wg      sync.WaitGroup
+}
+
+/*
+replica is where we are in a server's log. leave is closed when the server
+leaves, and nil while it's out of the cluster; done is closed when the
+goroutine replicating from it returns, and only that goroutine touches next.
+*/
+type replica struct {
+	next  uint64
+	leave chan struct{}
+	done  chan struct{}
+}
+
+/*
+If a server's stream fails while it's still in the cluster, say because it
+restarted, we dial it again, waiting minRetryInterval at first and twice as
+long after each failure in a row, up to maxRetryInterval.
+*/
+const (
+	minRetryInterval = 100 * time.Millisecond
+	maxRetryInterval = 5 * time.Second
+)
+
+/*
+Join(name, addr string) starts replicating from the server with the given
+name at the given address, unless we already are. If the server left and
+the goroutine replicating from it hasn't returned yet, the new one waits for
+it, so that only one appends the server's records at a time.
+*/
+func (r *Replicator) Join(name, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	if r.closed {
+		return nil
+	}
+	p, ok := r.servers[name]
+	if !ok {
+		p = &replica{}
+		r.servers[name] = p
+	}
+	if p.leave != nil {
+		return nil
+	}
+	prev := p.done
+	p.leave = make(chan struct{})
+	p.done = make(chan struct{})
+	r.wg.Add(1)
+	go r.replicate(name, addr, p, p.leave, p.done, prev)
+	return nil
+}
+
+/*
+replicate(name, addr, p, leave, done, prev) replicates from the server until
+it leaves or we close, once the previous goroutine replicating from it, if
+any, has closed prev. If replicating fails, we dial the server again and
+carry on from after the last record we replicated, backing off while it keeps
+failing.
+*/
+func (r *Replicator) replicate(
+	name, addr string,
+	p *replica,
+	leave, done, prev chan struct{},
+) {
+	defer r.wg.Done()
+	defer close(done)
+	if prev != nil {
+		<-prev
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-leave:
+		case <-r.close:
+		}
+		cancel()
+	}()
+
+	retry := minRetryInterval
+	for {
+		from := p.next
+		err := r.consume(ctx, addr, &p.next)
+		if ctx.Err() != nil {
+			return
+		}
+		r.logError(err, "failed to replicate", name, addr)
+		if p.next != from {
+			retry = minRetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > maxRetryInterval {
+			retry = maxRetryInterval
+		}
+	}
+}
+
+/*
+consume(ctx, addr, next) dials the server and streams its log from *next,
+appending each record to the local log and moving next past it. If the
+server has no record at next, because its log was truncated past it or
+reset, we start over from the server's lowest offset. It returns when the
+stream or an append fails, or the context is done.
+*/
+func (r *Replicator) consume(
+	ctx context.Context,
+	addr string,
+	next *uint64,
+) error {
+	cc, err := grpc.DialContext(ctx, addr, r.DialOptions...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+	for {
+		err = r.stream(ctx, client, next)
+		if status.Code(err) != codes.OutOfRange {
+			return err
+		}
+		res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+		if err != nil {
+			return err
+		}
+		*next = res.LowOffset
+	}
+}
+
+func (r *Replicator) stream(
+	ctx context.Context,
+	client api.LogClient,
+	next *uint64,
+) error {
+	stream, err := client.ConsumeStream(
+		ctx,
+		&api.ConsumeRequest{Offset: *next},
+	)
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		off := res.Record.Offset
+		if _, err = r.LocalLog.Append(res.Record); err != nil {
+			return err
+		}
+		*next = off + 1
+	}
+}
+
+/*
+Leave(name string) stops replicating from the server with the given name.
+*/
+func (r *Replicator) Leave(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	if p, ok := r.servers[name]; ok && p.leave != nil {
+		close(p.leave)
+		p.leave = nil
+	}
+	return nil
+}
+
+/*
+init() sets up the replicator the first time it's used, so that its zero
+value, with the exported fields set, is ready to use. The caller must hold the
+lock.
+*/
+func (r *Replicator) init() {
+	if r.logger == nil {
+		r.logger = r.Logger
+		if r.logger == nil {
+			r.logger = zap.NewNop()
+		}
+		r.logger = r.logger.Named("replicator")
+	}
+	if r.servers == nil {
+		r.servers = make(map[string]*replica)
+	}
+	if r.close == nil {
+		r.close = make(chan struct{})
+	}
+}
+
+/*
+Close() stops replicating from every server and waits for the goroutines
+replicating to return, so the local log can be closed after it.
+*/
+func (r *Replicator) Close() error {
+	r.mu.Lock()
+	r.init()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.close)
+	r.mu.Unlock()
+	r.wg.Wait()
+	return nil
+}
+
+func (r *Replicator) logError(err error, msg, name, addr string) {
+	r.logger.Error(
+		msg,
+		zap.Error(err),
+		zap.String("name", name),
+		zap.String("rpc_addr", addr),
+	)
+}
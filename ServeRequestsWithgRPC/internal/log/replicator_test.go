@@ -0,0 +1,128 @@
+package log
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/SStoyanov22/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+/*
+TestReplicator(*testing.T) runs three servers on loopback, the second and the
+third replicating from the first, and checks that the records produced to the
+first, before and after the others joined, become consumable on the others,
+that a server stops replicating once the first leaves it, and that when the
+first joins it again, it carries on where it stopped without copying the
+records it already has a second time.
+*/
+func TestReplicator(t *testing.T) {
+	var nodes []*replicaNode
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, setupReplicaNode(t))
+	}
+	ctx := context.Background()
+	produce := func(value string) {
+		_, err := nodes[0].client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+	// consumable(node, values) reports whether the node has the values at
+	// the first offsets, in order
+	consumable := func(node *replicaNode, values ...string) bool {
+		for i, value := range values {
+			res, err := node.client.Consume(ctx, &api.ConsumeRequest{
+				Offset: uint64(i),
+			})
+			if err != nil || string(res.Record.Value) != value {
+				return false
+			}
+		}
+		return true
+	}
+
+	produce("first")
+	for _, node := range nodes[1:] {
+		require.NoError(t, node.replicator.Join("0", nodes[0].addr))
+	}
+	produce("second")
+	produce("third")
+	for _, node := range nodes[1:] {
+		require.Eventually(t, func() bool {
+			return consumable(node, "first", "second", "third")
+		}, 3*time.Second, 50*time.Millisecond)
+	}
+
+	require.NoError(t, nodes[1].replicator.Leave("0"))
+	produce("fourth")
+	require.Eventually(t, func() bool {
+		return consumable(nodes[2], "first", "second", "third", "fourth")
+	}, 3*time.Second, 50*time.Millisecond)
+	_, high, err := nodes[1].log.Offsets()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), high)
+
+	require.NoError(t, nodes[1].replicator.Join("0", nodes[0].addr))
+	require.Eventually(t, func() bool {
+		return consumable(nodes[1], "first", "second", "third", "fourth")
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Never(t, func() bool {
+		_, high, err := nodes[1].log.Offsets()
+		require.NoError(t, err)
+		return high > 4
+	}, 500*time.Millisecond, 50*time.Millisecond)
+}
+
+type replicaNode struct {
+	log        *Log
+	addr       string
+	client     api.LogClient
+	replicator *Replicator
+}
+
+/*
+setupReplicaNode(t) starts a server on loopback serving a new log, without
+TLS or authorization, and a replicator for the log, and tears them down when
+the test ends.
+*/
+func setupReplicaNode(t *testing.T) *replicaNode {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "replicator-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{CommitLog: log})
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	dialOptions := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	cc, err := grpc.Dial(l.Addr().String(), dialOptions...)
+	require.NoError(t, err)
+	replicator := &Replicator{DialOptions: dialOptions, LocalLog: log}
+	t.Cleanup(func() {
+		require.NoError(t, replicator.Close())
+		cc.Close()
+		srv.Stop()
+		require.NoError(t, log.Close())
+	})
+	return &replicaNode{
+		log:        log,
+		addr:       l.Addr().String(),
+		client:     api.NewLogClient(cc),
+		replicator: replicator,
+	}
+}
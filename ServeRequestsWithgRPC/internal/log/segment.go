@@ -1,12 +1,15 @@
 package log
 
 import (
-	"fmt"
+	"errors"
+	"io"
 	"os"
-	"path"
+	"sync"
+	"time"
 
 	api "github.com/SStoyanov22/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 /*
@@ -20,8 +23,32 @@ when the segment is maxed out.
 type segment struct {
 	store                  *store
 	index                  *index
+	dir                    string
 	baseOffset, nextOffset uint64
 	config                 Config
+	dirty                  bool
+
+	// timeIndex maps timestamps to offsets; maxTimestamp is the latest
+	// record timestamp in the segment and timeIndexedAt is the store
+	// position of the record we last wrote a time index entry for
+	timeIndex     *timeIndex
+	maxTimestamp  int64
+	timeIndexedAt uint64
+
+	// created is when the segment was opened for appends, and modified is
+	// when its newest record was appended; we use them to roll and retain
+	// segments by age
+	created, modified time.Time
+
+	// readers counts the log readers still reading the segment's store
+	// outside the log's lock, and retired is set once the log has dropped
+	// the segment, so the last reader out removes its files; unless
+	// replaced is set because compaction has already put new files in
+	// their place, in which case we only close them
+	mu       sync.Mutex
+	readers  int
+	retired  bool
+	replaced bool
 }
 
 /*
@@ -36,16 +63,21 @@ is empty, then the next record appended to the segment would be the first
 record and its offset would be the segment’s base offset. If the index has at
 least one entry, then that means the offset of the next record written should
 take the offset at the end of the segment, which we get by adding 1 to the
-base offset and relative offset.
+base offset and relative offset. A new segment was created and last modified
+now; for a segment that already has records we don't know when it was
+created, so we use its store file's modification time for both, which Close
+sets to when the newest record was appended. So a segment's age always comes
+from our clock, never from the timestamps producers set on their records.
 */
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
+		dir:        dir,
 		baseOffset: baseOffset,
 		config:     c,
 	}
 	var err error
 	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		storePath(dir, baseOffset),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
 	)
@@ -55,8 +87,17 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
+	s.created = time.Now()
+	if s.store.size > 0 {
+		fi, err := storeFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+		s.created = fi.ModTime()
+	}
+	s.modified = s.created
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		indexPath(dir, baseOffset),
 		os.O_RDWR|os.O_CREATE,
 		0644,
 	)
@@ -71,6 +112,31 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+	timeIndexFile, err := os.OpenFile(
+		timeIndexPath(dir, baseOffset),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile); err != nil {
+		return nil, err
+	}
+	// the time index is sparse, so the latest timestamp may belong to a
+	// record after its last entry
+	if e, ok := s.timeIndex.Last(); ok {
+		s.maxTimestamp = e.timestamp
+		if _, pos, err := s.index.Read(int64(e.off)); err == nil {
+			s.timeIndexedAt = pos
+		}
+	}
+	if s.nextOffset > baseOffset {
+		if last, err := s.Read(s.nextOffset - 1); err == nil &&
+			last.Timestamp.AsTime().UnixNano() > s.maxTimestamp {
+			s.maxTimestamp = last.Timestamp.AsTime().UnixNano()
+		}
+	}
 	return s, nil
 }
 
@@ -81,28 +147,178 @@ appends a record in a two-step process: it appends the data to the store and
 then adds an index entry. Since index offsets are relative to the base offset,
 we subtract the segment’s next offset from its base offset (which are both
 absolute offsets) to get the entry’s relative offset in the segment. We then
-increment the next offset to prep for a future append call.
+increment the next offset to prep for a future append call. Records the
+producer didn't timestamp get stamped with the time we append them.
 */
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
-	p, err := proto.Marshal(record)
+	if record.Timestamp == nil {
+		record.Timestamp = timestamppb.Now()
+	}
+	if err = s.write(record); err != nil {
+		return 0, err
+	}
+	s.modified = time.Now()
+	return cur, nil
+}
+
+/*
+AppendBatch(records []*api.Record) appends the records to the segment as one
+batch and returns the first one's offset. The records get consecutive offsets
+and go into the store together, in a single frame, so a crash either leaves
+the whole batch in the store or none of it. Each record still gets its own
+index entry, all pointing at the batch's frame. We check that the index has
+room for every entry before we write anything; if it hasn't, we return io.EOF
+like the index does when it's full, and the log rolls to a new segment.
+*/
+func (s *segment) AppendBatch(records []*api.Record) (offset uint64, err error) {
+	if !s.fits(len(records)) {
+		return 0, io.EOF
+	}
+	base := s.nextOffset
+	now := timestamppb.Now()
+	for i, record := range records {
+		record.Offset = base + uint64(i)
+		if record.Timestamp == nil {
+			record.Timestamp = now
+		}
+	}
+	p, err := proto.Marshal(&api.RecordBatch{Records: records})
 	if err != nil {
 		return 0, err
 	}
-	_, pos, err := s.store.Append(p)
+	pos, err := s.appendFrame(p, attrBatch)
 	if err != nil {
 		return 0, err
 	}
+	for _, record := range records {
+		if err = s.index.Write(uint32(record.Offset-s.baseOffset), pos); err != nil {
+			return 0, err
+		}
+		if err = s.indexTime(record, pos); err != nil {
+			return 0, err
+		}
+	}
+	s.nextOffset = base + uint64(len(records))
+	s.dirty = true
+	s.modified = time.Now()
+	return base, nil
+}
+
+/*
+fits(n int) reports whether the segment's index has room for n more entries.
+*/
+func (s *segment) fits(n int) bool {
+	return s.index.size+uint64(n)*entWidth <= uint64(len(s.index.mmap))
+}
+
+/*
+write(record) writes the record to the store and indexes under the offset it
+already has. Append uses it after giving the record the next offset, and
+compaction uses it to copy surviving records into a new segment under their
+original offsets, which is why the next offset follows the record's offset
+rather than just counting up. We check that the index has room for the
+record's entry before we write it to the store, as AppendBatch does, so that
+a full index never leaves behind a frame in the store that it has no entry
+for.
+*/
+func (s *segment) write(record *api.Record) error {
+	if !s.fits(1) {
+		return io.EOF
+	}
+	p, err := proto.Marshal(record)
+	if err != nil {
+		return err
+	}
+	pos, err := s.appendFrame(p, 0)
+	if err != nil {
+		return err
+	}
 	if err = s.index.Write(
 		// index offsets are relative to base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		uint32(record.Offset-s.baseOffset),
 		pos,
 	); err != nil {
+		return err
+	}
+	if err = s.indexTime(record, pos); err != nil {
+		return err
+	}
+	s.nextOffset = record.Offset + 1
+	s.dirty = true
+	return nil
+}
+
+/*
+appendFrame(p []byte, attrs byte) compresses the given payload with the
+configured codec, encrypts it if the log has a key provider, and appends it
+to the store as a frame with the given attributes plus those saying how to
+decode it, returning the frame's position.
+*/
+func (s *segment) appendFrame(p []byte, attrs byte) (uint64, error) {
+	p, codec, err := compress(s.config.Compression.Codec, p)
+	if err != nil {
 		return 0, err
 	}
-	s.nextOffset++
-	return cur, nil
+	attrs |= codec
+	if kp := s.config.Encryption.KeyProvider; kp != nil {
+		if p, err = encrypt(kp, p); err != nil {
+			return 0, err
+		}
+		attrs |= attrEncrypted
+	}
+	_, pos, err := s.store.AppendFrame(p, attrs)
+	return pos, err
+}
+
+/*
+indexTime(record, pos) keeps the time index up to date with a record appended
+at the given store position. We only add an entry for a record that's later
+than every record before it, which keeps the index sorted even when producers
+set their own timestamps, and only once the configured number of store bytes
+have gone by since the last entry, which keeps the index sparse.
+*/
+func (s *segment) indexTime(record *api.Record, pos uint64) error {
+	ts := record.Timestamp.AsTime().UnixNano()
+	if ts <= s.maxTimestamp {
+		return nil
+	}
+	s.maxTimestamp = ts
+	if len(s.timeIndex.entries) > 0 &&
+		pos-s.timeIndexedAt < s.config.Segment.TimeIndexIntervalBytes {
+		return nil
+	}
+	s.timeIndexedAt = pos
+	return s.timeIndex.Write(ts, uint32(record.Offset-s.baseOffset))
+}
+
+/*
+OffsetForTime(ts int64) returns the offset of the first record in the segment
+timestamped at or after the given Unix nanosecond timestamp, and false if every
+record in the segment is earlier. The time index gets us to the last entry
+earlier than the timestamp; every record before that entry is earlier still,
+so we scan forward from it for the first record that isn't.
+*/
+func (s *segment) OffsetForTime(ts int64) (uint64, bool, error) {
+	if s.nextOffset == s.baseOffset || ts > s.maxTimestamp {
+		return 0, false, nil
+	}
+	rel, _ := s.timeIndex.Lookup(ts)
+	for off := s.baseOffset + uint64(rel); off < s.nextOffset; {
+		record, err := s.Read(off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if record.Timestamp.AsTime().UnixNano() >= ts {
+			return record.Offset, true, nil
+		}
+		off = record.Offset + 1
+	}
+	return 0, false, nil
 }
 
 /*
@@ -110,50 +326,291 @@ Returns the record for the given offset. Similar to writes, to read
 a record the segment must first translate the absolute index into a relative
 offset and get the associated index entry. Once it has the index entry, the
 segment can go straight to the record’s position in the store and read the
-proper amount of data.
+proper amount of data. If compaction removed the record, we return the next
+record that survived it instead, and io.EOF if none in this segment did; the
+returned record's offset tells the caller which one it got. If the store finds
+the record's frame corrupt, or it passes its checksum but doesn't decode, we
+report it as an api.ErrCorruptRecord; a frame we can't decrypt because its key
+is missing isn't corrupt, so we return the key error. A record
+appended in a batch shares its frame with the rest of the batch, so we decode
+the batch and pick the record out of it.
 */
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	rel, pos, err := s.index.Find(uint32(off - s.baseOffset))
 	if err != nil {
 		return nil, err
 	}
-	p, err := s.store.Read(pos)
+	off = s.baseOffset + uint64(rel)
+	f, err := s.store.ReadFrame(pos)
+	if err == errCorruptFrame {
+		return nil, api.ErrCorruptRecord{Offset: off}
+	}
 	if err != nil {
 		return nil, err
 	}
-	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	records, err := s.decodeFrame(f)
+	if errors.As(err, &keyError{}) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, api.ErrCorruptRecord{Offset: off}
+	}
+	for _, record := range records {
+		if record.Offset == off {
+			return record, nil
+		}
+	}
+	return nil, api.ErrCorruptRecord{Offset: off}
+}
+
+func (s *segment) decodeFrame(f frame) ([]*api.Record, error) {
+	return decodeFrame(s.config, f)
+}
+
+/*
+decodeFrame(c Config, f frame) decrypts and decompresses a frame and decodes
+its records: the frame's one record, or every record in its batch.
+*/
+func decodeFrame(c Config, f frame) ([]*api.Record, error) {
+	p := f.payload
+	var err error
+	if f.attrs&attrEncrypted != 0 {
+		if p, err = decrypt(c.Encryption.KeyProvider, p); err != nil {
+			return nil, err
+		}
+	}
+	if p, err = decompress(f.attrs, p); err != nil {
+		return nil, err
+	}
+	if f.attrs&attrBatch == 0 {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return nil, err
+		}
+		return []*api.Record{record}, nil
+	}
+	batch := &api.RecordBatch{}
+	if err := proto.Unmarshal(p, batch); err != nil {
+		return nil, err
+	}
+	return batch.Records, nil
+}
+
+/*
+recover() rebuilds the segment's indexes from its store after an unclean
+shutdown. Until the index is closed, its file is the full preallocated size, so
+after a crash neither its size nor the next offset we derived from it can be
+trusted. We walk the store's frames from the start and write an index entry for
+each record we can read, one per record for a batch. A corrupt frame in the middle of the store still gets
+an entry, under the next offset, so that reading it reports the corruption
+instead of hiding every record behind it. A corrupt or partial frame at the end
+of the store is what a torn write leaves behind, so we truncate the store to
+discard it. A frame we can't decrypt because its key is missing isn't
+corrupt, so rather than discard it we fail and leave the store as it is.
+Older versions could leave a frame in the store that a full index had no room
+for, when the append that wrote it failed; since no one was told it was
+appended, we stop at the index's capacity and discard the rest of the store
+too. We return the number of records indexed and bytes discarded.
+*/
+func (s *segment) recover() (records, truncated uint64, err error) {
+	s.index.size = 0
+	s.nextOffset = s.baseOffset
+	if err = s.timeIndex.reset(); err != nil {
+		return 0, 0, err
+	}
+	s.maxTimestamp = 0
+	s.timeIndexedAt = 0
+	var pos uint64
+	for pos < s.store.size {
+		f, err := s.store.ReadFrame(pos)
+		if err != nil && err != errCorruptFrame {
+			return 0, 0, err
+		}
+		var batch []*api.Record
+		if err == nil {
+			batch, err = s.decodeFrame(f)
+		}
+		if errors.As(err, &keyError{}) {
+			return 0, 0, err
+		}
+		if err != nil {
+			if f.width == 0 || pos+f.width >= s.store.size {
+				break
+			}
+			batch = []*api.Record{{Offset: s.nextOffset}}
+		}
+		if !s.fits(len(batch)) {
+			break
+		}
+		for _, record := range batch {
+			if err = s.index.Write(
+				uint32(record.Offset-s.baseOffset),
+				pos,
+			); err != nil {
+				return 0, 0, err
+			}
+			if err = s.indexTime(record, pos); err != nil {
+				return 0, 0, err
+			}
+			s.nextOffset = record.Offset + 1
+			records++
+		}
+		pos += f.width
+	}
+	if pos < s.store.size {
+		truncated = s.store.size - pos
+		if err = s.store.truncate(pos); err != nil {
+			return 0, 0, err
+		}
+	}
+	return records, truncated, nil
 }
 
 /*
 Returns whether the segment has reached its max size, either by
 writing too much to the store or the index. If you wrote a small number of
 long logs, then you’d hit the segment bytes limit; if you wrote a lot of small
-logs, then you’d hit the index bytes limit. The log uses this method to know
-it needs to create a new segment.
+logs, then you’d hit the index bytes limit, or run out of room for another
+entry when the limit isn't a multiple of an entry's width. The store's size counts the bytes
+we actually wrote, so with compression on, a segment holds as many records as
+fit in its max store bytes once compressed. If the segment has a max age, a
+segment that has been open for longer than that is maxed too, however small,
+so that a quiet log still rolls its segments and retention can delete them.
+The log uses this method to know it needs to create a new segment.
 */
 func (s *segment) IsMaxed() bool {
+	maxAge := s.config.Segment.MaxAge
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+		s.index.size >= s.config.Segment.MaxIndexBytes || !s.fits(1) ||
+		(maxAge > 0 && time.Since(s.created) >= maxAge)
+}
+
+// Returns the bytes the segment takes up on disk.
+func (s *segment) size() uint64 {
+	return s.store.size + s.index.size
 }
 
 /*
-Closes the segment and removes the index and store files.
+acquire() and release() bracket a read of the segment's store that happens
+outside the log's lock, such as through Log.Reader(). If the log retires the
+segment in the meantime, release() removes it once the last reader is done.
 */
-func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
+func (s *segment) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readers++
+}
+
+func (s *segment) release() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readers--
+	if s.retired && s.readers == 0 {
+		return s.discard()
+	}
+	return nil
+}
+
+/*
+retire() removes a segment the log has dropped. If readers are still reading
+the segment's store, we leave the files in place and the last reader removes
+them when it's done, so deleting old segments never pulls a file out from
+under a reader.
+*/
+func (s *segment) retire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retired = true
+	if s.readers > 0 {
+		return nil
+	}
+	return s.discard()
+}
+
+/*
+replace() retires a segment whose files compaction has already replaced, so
+we only close them.
+*/
+func (s *segment) replace() error {
+	s.mu.Lock()
+	s.replaced = true
+	s.mu.Unlock()
+	return s.retire()
+}
+
+/*
+evict() retires a segment whose base offset the log is about to reuse, so we
+can't leave its files for its last reader to remove: they'd be the new
+segment's files by then. We remove them now instead, and the readers carry on
+reading through the files they have open, as they would with a replaced
+segment's, until the last one closes them.
+*/
+func (s *segment) evict() error {
+	if err := s.removeFiles(); err != nil {
+		return err
+	}
+	return s.replace()
+}
+
+func (s *segment) discard() error {
+	if s.replaced {
+		return s.Close()
+	}
+	return s.Remove()
+}
+
+/*
+Syncs the records appended since the last sync to stable storage: we flush the
+store's buffer and sync its file, and then sync the index's memory map. We sync
+the store first so an index entry never reaches the disk before its record.
+*/
+func (s *segment) Sync() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.store.Sync(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := s.index.Sync(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := s.timeIndex.Sync(); err != nil {
 		return err
 	}
+	s.dirty = false
 	return nil
 }
 
+/*
+Closes the segment and removes the index and store files.
+*/
+func (s *segment) Remove() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return s.removeFiles()
+}
+
+func (s *segment) removeFiles() error {
+	for _, name := range []string{
+		indexPath(s.dir, s.baseOffset),
+		storePath(s.dir, s.baseOffset),
+		timeIndexPath(s.dir, s.baseOffset),
+	} {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Close() closes the segment's files. Flushing the store's buffer writes to its
+file, maybe well after the newest record was appended, so we then set the
+file's modification time to when it was, for the next process to read in
+newSegment; unless compaction replaced the files, in which case they aren't
+ours anymore.
+*/
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return err
@@ -161,7 +618,13 @@ func (s *segment) Close() error {
 	if err := s.store.Close(); err != nil {
 		return err
 	}
-	return nil
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
+	if s.replaced {
+		return nil
+	}
+	return os.Chtimes(s.store.Name(), s.modified, s.modified)
 }
 
 /*
@@ -0,0 +1,126 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+)
+
+/*
+Offsets() returns the log's range: its lowest offset, and the offset the next
+appended record will get. The log holds the offsets from low up to, but not
+including, high, and they're equal when it holds no records. Unlike
+HighestOffset, that tells an empty log apart from one with a single record.
+*/
+func (l *Log) Offsets() (low, high uint64, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.done == nil {
+		return 0, 0, api.ErrLogClosed{}
+	}
+	return l.segments[0].baseOffset, l.activeSegment.nextOffset, nil
+}
+
+/*
+Stats() describes the log: its range, as Offsets returns it, how many
+segments it has and the bytes they take up on disk, and how many records
+per second were appended to it over the last minute.
+*/
+func (l *Log) Stats() (*api.LogStats, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.done == nil {
+		return nil, api.ErrLogClosed{}
+	}
+	stats := &api.LogStats{
+		LowOffset:  l.segments[0].baseOffset,
+		HighOffset: l.activeSegment.nextOffset,
+		Segments:   uint64(len(l.segments)),
+		AppendRate: l.appendRate.rate(time.Now()),
+	}
+	for _, s := range l.segments {
+		stats.Bytes += s.size()
+	}
+	return stats, nil
+}
+
+/*
+Segments() describes the log's segments, from oldest to newest; the last one
+is the active segment.
+*/
+func (l *Log) Segments() ([]*api.Segment, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.done == nil {
+		return nil, api.ErrLogClosed{}
+	}
+	segments := make([]*api.Segment, 0, len(l.segments))
+	for _, s := range l.segments {
+		segments = append(segments, &api.Segment{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.size,
+			IndexBytes: s.index.size,
+			Records:    s.index.size / entWidth,
+		})
+	}
+	return segments, nil
+}
+
+/*
+rateWindow is how far back the log's append rate looks.
+*/
+const rateWindow = 60
+
+/*
+appendRate counts the records appended to the log in one-second buckets, one
+for each second of the rate window, reusing a bucket once its second has
+fallen out of the window. Counting this way costs the same however fast we
+append, and a rate only needs to add up the buckets.
+*/
+type appendRate struct {
+	// start is when we started counting, so that we don't average a log
+	// that's younger than the window over the whole window
+	start   time.Time
+	counts  [rateWindow]uint64
+	seconds [rateWindow]int64
+}
+
+func newAppendRate(now time.Time) *appendRate {
+	return &appendRate{start: now}
+}
+
+/*
+add(now time.Time, n uint64) counts n records appended at the given time.
+*/
+func (r *appendRate) add(now time.Time, n uint64) {
+	sec := now.Unix()
+	i := sec % rateWindow
+	if r.seconds[i] != sec {
+		r.seconds[i] = sec
+		r.counts[i] = 0
+	}
+	r.counts[i] += n
+}
+
+/*
+rate(now time.Time) returns the records appended per second over the window
+up to the given time, or since we started counting if that's more recent.
+*/
+func (r *appendRate) rate(now time.Time) float64 {
+	sec := now.Unix()
+	var total uint64
+	for i, s := range r.seconds {
+		if sec-s < rateWindow {
+			total += r.counts[i]
+		}
+	}
+	window := now.Sub(r.start)
+	if window > rateWindow*time.Second {
+		window = rateWindow * time.Second
+	}
+	if window < time.Second {
+		window = time.Second
+	}
+	return float64(total) / window.Seconds()
+}
@@ -0,0 +1,31 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+/*
+TestAppendRate(*testing.T) tests that the append rate averages over the time
+since we started counting until that's longer than the window, and then only
+counts the appends within the window.
+*/
+func TestAppendRate(t *testing.T) {
+	start := time.Unix(1000, 0)
+	r := newAppendRate(start)
+	require.Equal(t, 0.0, r.rate(start))
+
+	r.add(start, 10)
+	require.Equal(t, 10.0, r.rate(start))
+	r.add(start.Add(9*time.Second), 10)
+	require.Equal(t, 2.0, r.rate(start.Add(10*time.Second)))
+
+	// the first ten fall out of the window
+	require.Equal(t, 10.0/rateWindow, r.rate(start.Add(rateWindow*time.Second)))
+	// and a bucket reused for a later second starts over
+	r.add(start.Add(rateWindow*time.Second), 5)
+	require.Equal(t, 15.0/rateWindow, r.rate(start.Add(rateWindow*time.Second)))
+	require.Equal(t, 0.0, r.rate(start.Add(10*rateWindow*time.Second)))
+}
@@ -2,19 +2,70 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
 	"sync"
 )
 
 var (
 	enc = binary.BigEndian
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	// errCorruptFrame is returned by store.Read when a record frame fails
+	// its checksum or is cut short; the segment turns it into an
+	// api.ErrCorruptRecord carrying the record's offset.
+	errCorruptFrame = errors.New("corrupt record frame")
 )
 
+/*
+Every record in the store is written as a frame. The first lenWidth bytes hold
+the frame header word: the high byte is the frame version, the next byte holds
+the frame's attributes and the remaining six bytes hold the payload length.
+Version 1 frames follow the header with a CRC32C (Castagnoli) checksum of the
+payload and then the payload itself. Stores written before frames were
+versioned only have an 8 byte length prefix; since no record is anywhere near
+2^56 bytes, their high byte is always zero, which we read as frame version 0.
+*/
 const (
 	lenWidth = 8
+	crcWidth = 4
+
+	frameLegacy  byte = 0
+	frameVersion byte = 1
+
+	frameLenMask = 1<<48 - 1
+)
+
+/*
+Frame attributes tell the segment how to decode a frame's payload. A frame
+with no attributes holds a single, uncompressed, plaintext record; attrBatch
+marks a frame holding a batch of records that were appended together, the two
+bits under attrCodecMask hold the ID of the codec that compressed it, and
+attrEncrypted marks a frame encrypted after compression.
+*/
+const (
+	attrBatch      byte = 1 << 0
+	attrCodecShift      = 1
+	attrCodecMask  byte = 3 << attrCodecShift
+	attrEncrypted  byte = 1 << 3
 )
 
+/*
+frame is a frame read back from the store: its attributes, its payload, and
+its full width in the store, header included.
+*/
+type frame struct {
+	attrs   byte
+	payload []byte
+	width   uint64
+}
+
 type store struct {
 	*os.File
 	mu   sync.Mutex
@@ -36,8 +87,10 @@ func newStore(f *os.File) (*store, error) {
 }
 
 /*
-Append([]byte) persists the given bytes to the store. We write the length of the
-record so that, when we read the record, we know how many bytes to read.
+Append([]byte) persists the given bytes to the store. We write the frame header
+with the length of the record so that, when we read the record, we know how
+many bytes to read, followed by the checksum of the record so that we can tell
+whether the bytes we read back are the ones we wrote.
 We write to the buffered writer instead of directly to the file to reduce the
 number of system calls and improve performance. If a user wrote a lot of
 small records, this would help a lot. Then we return the number of bytes
@@ -46,10 +99,21 @@ store holds the record in its file. The segment will use this position when it
 creates an associated index entry for this record.
 */
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
+	return s.AppendFrame(p, 0)
+}
+
+/*
+AppendFrame(p []byte, attrs byte) appends the given bytes to the store like
+Append, in a frame with the given attributes.
+*/
+func (s *store) AppendFrame(p []byte, attrs byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	header := make([]byte, lenWidth+crcWidth)
+	enc.PutUint64(header, frameHeader(frameVersion, attrs, uint64(len(p))))
+	enc.PutUint32(header[lenWidth:], crc32.Checksum(p, castagnoli))
+	if _, err := s.buf.Write(header); err != nil {
 		return 0, 0, err
 	}
 	w, err := s.buf.Write(p)
@@ -57,9 +121,9 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 		return 0, 0, err
 	}
 
-	//w is the number of bytes written to the bufWriter and lenWidth(8 bytes = 64 bits) represents the size
-	// of the byte array we are appending to the bufWriter; thats why we increas w with 64 more bytes
-	w += lenWidth
+	// w is the number of bytes of the record written to the bufWriter; the
+	// frame header and checksum written before it take up the rest of the frame
+	w += lenWidth + crcWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
@@ -68,28 +132,148 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 Read(pos uint64) returns the record stored at the given position. First it flushes
 the writer buffer, in case we’re about to try to read a record that the buffer
 hasn’t flushed to disk yet. We find out how many bytes we have to read to
-get the whole record, and then we fetch and return the record. The compiler
+get the whole record, and then we fetch the record and verify its checksum
+before returning it. A frame that fails its checksum, is cut short, or has a
+version we don't know returns errCorruptFrame. The compiler
 allocates byte slices that don’t escape the functions they’re declared in on the
 stack. A value escapes when it lives beyond the lifetime of the function call—if
 you return the value, for example.
 */
 func (s *store) Read(pos uint64) ([]byte, error) {
+	f, err := s.ReadFrame(pos)
+	return f.payload, err
+}
+
+/*
+ReadFrame(pos uint64) reads the frame at the given position and returns its
+attributes and payload along with the frame's full width, so callers scanning
+the store know where the next frame starts. The width is also returned for a
+frame that fails its checksum, since its header was intact; it is zero when
+the frame's header is unreadable or runs past the end of the store.
+*/
+func (s *store) ReadFrame(pos uint64) (frame, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
-		return nil, err
+		return frame{}, err
 	}
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	// a torn write can leave less than a whole header at the end of the store
+	if pos+lenWidth > s.size {
+		return frame{}, errCorruptFrame
 	}
-	b := make([]byte, enc.Uint64(size))
+	header := make([]byte, lenWidth)
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
+		return frame{}, err
+	}
+	version, attrs, size := parseFrameHeader(enc.Uint64(header))
+	width := size
+	switch version {
+	case frameLegacy:
+	case frameVersion:
+		width += crcWidth
+	default:
+		return frame{}, errCorruptFrame
+	}
+	// or a header whose frame runs past the end of the store
+	if width > s.size-pos-lenWidth {
+		return frame{}, errCorruptFrame
+	}
+	b := make([]byte, width)
 	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
-		return nil, err
+		return frame{}, err
+	}
+	f := frame{attrs: attrs, width: lenWidth + width}
+	if version == frameLegacy {
+		f.payload = b
+		return f, nil
+	}
+	if crc32.Checksum(b[crcWidth:], castagnoli) != enc.Uint32(b) {
+		return frame{width: f.width}, errCorruptFrame
+	}
+	f.payload = b[crcWidth:]
+	return f, nil
+}
+
+/*
+readFrame(r io.Reader, max uint64) reads the next frame from a stream of the
+store's frames, like the one Log.Reader() returns, checking it the way
+ReadFrame does. It returns io.EOF when the stream ends between frames. Unlike
+ReadFrame, we don't know how much the stream holds, so a corrupt header could
+claim any width: we reject a frame wider than max, and read the payload into a
+buffer that grows as the bytes arrive rather than allocating the width up
+front, so a corrupt header in a short stream fails as soon as the stream ends.
+*/
+func readFrame(r io.Reader, max uint64) (frame, error) {
+	header := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, header); err == io.ErrUnexpectedEOF {
+		return frame{}, errCorruptFrame
+	} else if err != nil {
+		return frame{}, err
+	}
+	version, attrs, size := parseFrameHeader(enc.Uint64(header))
+	width := size
+	switch version {
+	case frameLegacy:
+	case frameVersion:
+		width += crcWidth
+	default:
+		return frame{}, errCorruptFrame
+	}
+	if size > max {
+		return frame{}, errCorruptFrame
+	}
+	var buf bytes.Buffer
+	if n, err := io.CopyN(&buf, r, int64(width)); n < int64(width) {
+		if err == nil || err == io.EOF {
+			return frame{}, errCorruptFrame
+		}
+		return frame{}, err
 	}
-	return b, nil
+	b := buf.Bytes()
+	f := frame{attrs: attrs, width: lenWidth + width}
+	if version == frameLegacy {
+		f.payload = b
+		return f, nil
+	}
+	if crc32.Checksum(b[crcWidth:], castagnoli) != enc.Uint32(b) {
+		return frame{}, errCorruptFrame
+	}
+	f.payload = b[crcWidth:]
+	return f, nil
+}
+
+/*
+maxFrameBytes(c Config) returns the largest payload a frame can have in a log
+with the given config, for readFrame to reject wider frames. A frame holds a
+record, or a batch of at most as many records as an index has room for, each
+no larger than the max record size plus the offset and timestamp the log gives
+it, and frameSlack covers the batch's encoding and what compression and
+encryption add. A config whose frames could be larger than we can count has
+no limit.
+*/
+func maxFrameBytes(c Config) uint64 {
+	records := c.Segment.MaxIndexBytes / entWidth
+	if records == 0 {
+		records = 1
+	}
+	record := c.MaxRecordBytes + recordOverhead
+	if record < c.MaxRecordBytes || records > math.MaxUint64/record {
+		return math.MaxUint64
+	}
+	n := records * record
+	slack := n/frameSlackRatio + frameSlack
+	if n > math.MaxUint64-slack {
+		return math.MaxUint64
+	}
+	return n + slack
 }
 
+const (
+	recordOverhead  = 64
+	frameSlack      = 1 << 10
+	frameSlackRatio = 4
+)
+
 /*
 ReadAt(p []byte, off int64) reads len(p) bytes into p beginning at the off offset in the
 store’s file. It implements io.ReaderAt on the store type.
@@ -103,6 +287,36 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+/*
+Sync() flushes the writer buffer and commits the store's file to stable storage.
+*/
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+/*
+truncate(size uint64) discards everything in the store past the given size,
+which we use to drop a record that was only partially written when the
+process died.
+*/
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
 //Close() persists any buffered data before closing the file
 func (s *store) Close() error {
 	s.mu.Lock()
@@ -113,3 +327,19 @@ func (s *store) Close() error {
 	}
 	return s.File.Close()
 }
+
+/*
+frameHeader packs the frame version, attributes and payload length into the
+header word written at the start of every frame; parseFrameHeader unpacks it.
+*/
+func frameHeader(version, attrs byte, size uint64) uint64 {
+	return uint64(version)<<56 | uint64(attrs)<<48 | size&frameLenMask
+}
+
+func parseFrameHeader(h uint64) (version, attrs byte, size uint64) {
+	version = byte(h >> 56)
+	if version == frameLegacy {
+		return version, 0, h
+	}
+	return version, byte(h >> 48), h & frameLenMask
+}
@@ -1,8 +1,11 @@
 package log
 
 import (
+	"bytes"
 	"io/ioutil"
+	"math"
 	"os"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -10,7 +13,7 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + lenWidth + crcWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -59,7 +62,16 @@ func testReadAt(t *testing.T, s *store) {
 		require.Equal(t, lenWidth, n)
 		off += int64(n)
 
-		size := enc.Uint64(b)
+		version, attrs, size := parseFrameHeader(enc.Uint64(b))
+		require.Equal(t, frameVersion, version)
+		require.Equal(t, byte(0), attrs)
+
+		b = make([]byte, crcWidth)
+		n, err = s.ReadAt(b, off)
+		require.NoError(t, err)
+		require.Equal(t, crcWidth, n)
+		off += int64(n)
+
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
@@ -69,6 +81,73 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreCorruptRecord(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_corrupt_record_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.Close())
+
+	// flip a bit in the second record's payload
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(width+lenWidth+crcWidth))
+	require.NoError(t, err)
+	b[0] ^= 0x01
+	_, err = f.WriteAt(b, int64(width+lenWidth+crcWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	_, err = s.Read(width)
+	require.Equal(t, errCorruptFrame, err)
+
+	// a torn write leaves a frame shorter than its header says
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Truncate(f.Name(), int64(width*3-1)))
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	_, err = s.Read(width * 2)
+	require.Equal(t, errCorruptFrame, err)
+}
+
+func TestStoreReadLegacyFrames(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_legacy_frames_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// records written before frames were versioned only have a length prefix
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, uint64(len(write)))
+	_, err = f.Write(append(b, write...))
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(write))+lenWidth, pos)
+
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
@@ -103,3 +182,31 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+/*
+TestReadFrameCorruptWidth(*testing.T) tests that readFrame rejects a frame
+whose header claims more than the max frame size, and one whose header claims
+more than the stream holds, without allocating what the header claims.
+*/
+func TestReadFrameCorruptWidth(t *testing.T) {
+	header := make([]byte, lenWidth)
+	enc.PutUint64(header, frameHeader(frameVersion, 0, 1<<40))
+	stream := append(header, make([]byte, 100)...)
+
+	_, err := readFrame(bytes.NewReader(stream), 1<<20)
+	require.Equal(t, errCorruptFrame, err)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = readFrame(bytes.NewReader(stream), math.MaxUint64)
+	runtime.ReadMemStats(&after)
+	require.Equal(t, errCorruptFrame, err)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	c := Config{}
+	c.MaxRecordBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	require.Greater(t, maxFrameBytes(c), uint64(1<<20))
+	c.MaxRecordBytes = math.MaxUint64
+	require.Equal(t, uint64(math.MaxUint64), maxFrameBytes(c))
+}
@@ -0,0 +1,127 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+var (
+	tsWidth      uint64 = 8
+	timeEntWidth        = tsWidth + offWidth
+)
+
+/*
+timeIndex maps record timestamps to offsets so we can find where to start
+reading the records appended at or after a given time. Unlike the offset index
+it's sparse: the segment only writes an entry once enough of the store has
+gone by since the last entry and the record's timestamp is later than every
+one before it, so the entries' timestamps and offsets both only ever increase.
+Since it's small, we keep its entries in memory and just append new ones to
+the file rather than memory-mapping it.
+*/
+type timeIndex struct {
+	file    *os.File
+	entries []timeEntry
+}
+
+type timeEntry struct {
+	// timestamp is in Unix nanoseconds and off is relative to the
+	// segment's base offset, like the offset index's entries
+	timestamp int64
+	off       uint32
+}
+
+/*
+Creates a time index for the given file and loads its entries. If the process
+died midway through writing an entry, we drop the partial entry.
+*/
+func newTimeIndex(f *os.File) (*timeIndex, error) {
+	t := &timeIndex{
+		file: f,
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	n := uint64(len(b)) / timeEntWidth * timeEntWidth
+	for pos := uint64(0); pos < n; pos += timeEntWidth {
+		t.entries = append(t.entries, timeEntry{
+			timestamp: int64(enc.Uint64(b[pos : pos+tsWidth])),
+			off:       enc.Uint32(b[pos+tsWidth : pos+timeEntWidth]),
+		})
+	}
+	if n < uint64(len(b)) {
+		if err = f.Truncate(int64(n)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+/*
+Appends an entry mapping the given timestamp to the given relative offset.
+*/
+func (t *timeIndex) Write(timestamp int64, off uint32) error {
+	b := make([]byte, timeEntWidth)
+	enc.PutUint64(b[:tsWidth], uint64(timestamp))
+	enc.PutUint32(b[tsWidth:], off)
+	if _, err := t.file.Write(b); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, timeEntry{timestamp: timestamp, off: off})
+	return nil
+}
+
+/*
+Lookup(timestamp int64) returns the relative offset to start scanning from to
+find the first record at or after the given timestamp: the offset of the last
+entry whose timestamp is earlier than it. If there's no such entry, the scan
+starts at the beginning of the segment and ok is false.
+*/
+func (t *timeIndex) Lookup(timestamp int64) (off uint32, ok bool) {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].timestamp >= timestamp
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return t.entries[i-1].off, true
+}
+
+/*
+Returns the last entry in the index, if there is one.
+*/
+func (t *timeIndex) Last() (timeEntry, bool) {
+	if len(t.entries) == 0 {
+		return timeEntry{}, false
+	}
+	return t.entries[len(t.entries)-1], true
+}
+
+/*
+reset() drops every entry, so that a segment recovering from an unclean
+shutdown can rebuild its time index along with its offset index.
+*/
+func (t *timeIndex) reset() error {
+	if err := t.file.Truncate(0); err != nil {
+		return err
+	}
+	t.entries = nil
+	return nil
+}
+
+func (t *timeIndex) Sync() error {
+	return t.file.Sync()
+}
+
+func (t *timeIndex) Close() error {
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
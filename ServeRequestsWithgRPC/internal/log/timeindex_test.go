@@ -0,0 +1,64 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	idx, err := newTimeIndex(f)
+	require.NoError(t, err)
+	_, ok := idx.Last()
+	require.False(t, ok)
+	_, ok = idx.Lookup(100)
+	require.False(t, ok)
+
+	entries := []timeEntry{
+		{timestamp: 100, off: 0},
+		{timestamp: 200, off: 5},
+		{timestamp: 300, off: 9},
+	}
+	for _, e := range entries {
+		require.NoError(t, idx.Write(e.timestamp, e.off))
+	}
+
+	// lookups start from the last entry earlier than the timestamp
+	for ts, want := range map[int64]uint32{
+		101: 0,
+		200: 0,
+		250: 5,
+		301: 9,
+	} {
+		off, ok := idx.Lookup(ts)
+		require.True(t, ok)
+		require.Equal(t, want, off)
+	}
+	_, ok = idx.Lookup(100)
+	require.False(t, ok)
+	require.NoError(t, idx.Close())
+
+	// time index should build its state from the existing file and drop a
+	// partially written entry
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	_, err = f.Seek(0, 0)
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f)
+	require.NoError(t, err)
+	last, ok := idx.Last()
+	require.True(t, ok)
+	require.Equal(t, entries[2], last)
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(timeEntWidth)*3, fi.Size())
+	require.NoError(t, idx.Close())
+}
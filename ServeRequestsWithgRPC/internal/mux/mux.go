@@ -0,0 +1,153 @@
+package mux
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/soheilhy/cmux"
+)
+
+/*
+Mux serves a server's gRPC service, its peer stream and its HTTP endpoint on
+one listener, so each server needs a single port opened in the firewall. It
+reads the start of each connection it accepts to tell which protocol it
+speaks and hands it to the listener for that protocol, with the bytes it read
+put back, so each server reads the connection as if it had accepted it
+itself:
+
+  - a connection whose first byte is the peer marker, like log.RaftRPC, goes
+    to the peer stream, which starts TLS after the marker if it's configured;
+  - a connection that starts with HTTP/2's preface, or with a TLS handshake
+    whose client offers h2 alone over ALPN, as gRPC's clients do, goes to
+    gRPC;
+  - and any other connection, plain or TLS, goes to HTTP.
+
+We only sniff the connections, and the servers terminate TLS themselves, so
+the gRPC server still sees its clients' certificates to authenticate them.
+*/
+type Mux struct {
+	cmux cmux.CMux
+	root net.Listener
+	peer net.Listener
+	grpc net.Listener
+	http net.Listener
+}
+
+/*
+sniffTimeout is how long we wait for a connection's first bytes before we
+give up on it, so a client that connects and sends nothing doesn't hold a
+goroutine forever.
+*/
+const sniffTimeout = 10 * time.Second
+
+/*
+New(ln net.Listener, peerMarker byte) creates a mux for the listener that
+sends the connections that start with peerMarker to the peer stream.
+*/
+func New(ln net.Listener, peerMarker byte) *Mux {
+	m := &Mux{cmux: cmux.New(ln), root: ln}
+	m.cmux.SetReadTimeout(sniffTimeout)
+	// cmux tries the listeners in the order we add them, so the catch-all
+	// HTTP listener goes last
+	m.peer = m.cmux.Match(firstByte(peerMarker))
+	m.grpc = m.cmux.Match(cmux.HTTP2(), offersOnlyH2)
+	m.http = m.cmux.Match(cmux.Any())
+	return m
+}
+
+/*
+Peer(), GRPC() and HTTP() return the listeners for each protocol's server to
+serve on. Closing any of them closes the mux's listener.
+*/
+func (m *Mux) Peer() net.Listener {
+	return m.peer
+}
+
+func (m *Mux) GRPC() net.Listener {
+	return m.grpc
+}
+
+func (m *Mux) HTTP() net.Listener {
+	return m.http
+}
+
+/*
+Serve() accepts connections and hands them to the protocols' listeners until
+the mux's listener is closed. Every protocol's listener must be served, since
+a connection waits for its listener to accept it.
+*/
+func (m *Mux) Serve() error {
+	return m.cmux.Serve()
+}
+
+/*
+Close() closes the mux's listener and the protocols' listeners, which fail the
+servers' Accept calls.
+*/
+func (m *Mux) Close() error {
+	m.cmux.Close()
+	err := m.root.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func firstByte(b byte) cmux.Matcher {
+	return func(r io.Reader) bool {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return false
+		}
+		return buf[0] == b
+	}
+}
+
+/*
+offersOnlyH2(r io.Reader) reports whether the connection starts with a TLS
+ClientHello that offers h2 as its only application protocol. gRPC's clients
+offer h2 alone, while HTTP clients offer http/1.1, alongside h2 if they speak
+it, or no protocol at all.
+
+Rather than parse the ClientHello ourselves, we start a TLS handshake on
+what we read and stop it once crypto/tls has parsed the ClientHello, which
+it gives to GetConfigForClient.
+*/
+func offersOnlyH2(r io.Reader) bool {
+	var protos []string
+	conn := tls.Server(&sniffConn{r: r}, &tls.Config{
+		GetConfigForClient: func(
+			hello *tls.ClientHelloInfo,
+		) (*tls.Config, error) {
+			protos = hello.SupportedProtos
+			return nil, errSniffed
+		},
+	})
+	if err := conn.Handshake(); !errors.Is(err, errSniffed) {
+		return false
+	}
+	return len(protos) == 1 && protos[0] == "h2"
+}
+
+var errSniffed = errors.New("sniffed the client hello")
+
+/*
+sniffConn is the connection we run the TLS handshake on when we sniff a
+ClientHello. It reads from what cmux has buffered and drops what the handshake
+writes, like the alert it sends when we stop it, so the client never sees it.
+*/
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *sniffConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
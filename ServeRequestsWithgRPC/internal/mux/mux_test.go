@@ -0,0 +1,176 @@
+package mux
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/SStoyanov22/proglog/internal/config"
+	"github.com/SStoyanov22/proglog/internal/log"
+	"github.com/SStoyanov22/proglog/internal/server"
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+/*
+TestMux(*testing.T) serves gRPC, a Raft peer stream and HTTP on one loopback
+port, in plaintext and over TLS, and checks that a client of each protocol
+reaches the right server.
+*/
+func TestMux(t *testing.T) {
+	for scenario, secure := range map[string]bool{
+		"plaintext": false,
+		"tls":       true,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			testMux(t, secure)
+		})
+	}
+}
+
+func testMux(t *testing.T, secure bool) {
+	var serverTLS, clientTLS *tls.Config
+	if secure {
+		certDir := setupCerts(t)
+		var err error
+		serverTLS, err = config.SetupTLSConfig(config.TLSConfig{
+			CertFile: config.CertFile(certDir, "server"),
+			KeyFile:  config.KeyFile(certDir, "server"),
+			CAFile:   config.CertFile(certDir, "ca"),
+			Server:   true,
+		})
+		require.NoError(t, err)
+		clientTLS, err = config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      config.CertFile(certDir, "root-client"),
+			KeyFile:       config.KeyFile(certDir, "root-client"),
+			CAFile:        config.CertFile(certDir, "ca"),
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	m := New(ln, log.RaftRPC)
+	addr := ln.Addr().String()
+
+	dir, err := ioutil.TempDir("", "mux-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { clog.Close() })
+	reg := prometheus.NewRegistry()
+	gsrv, err := server.NewGRPCServer(&server.Config{
+		CommitLog: clog,
+		TLS:       serverTLS,
+		Metrics:   reg,
+	})
+	require.NoError(t, err)
+	go gsrv.Serve(m.GRPC())
+	t.Cleanup(gsrv.Stop)
+
+	// the peer stream echoes what the other server writes
+	peers := log.NewStreamLayer(m.Peer(), serverTLS, clientTLS)
+	go func() {
+		for {
+			conn, err := peers.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	httpLn := m.HTTP()
+	if secure {
+		httpLn = tls.NewListener(httpLn, serverTLS)
+	}
+	hsrv := &http.Server{
+		Handler: promhttp.HandlerFor(reg, promhttp.HandlerOpts{}),
+	}
+	go hsrv.Serve(httpLn)
+	t.Cleanup(func() { hsrv.Close() })
+
+	go m.Serve()
+	t.Cleanup(func() { require.NoError(t, m.Close()) })
+
+	// gRPC
+	creds := insecure.NewCredentials()
+	if secure {
+		creds = credentials.NewTLS(clientTLS)
+	}
+	cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+
+	// the peer stream
+	conn, err := peers.Dial(raft.ServerAddress(addr), time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(b))
+
+	// HTTP; over TLS the client offers h2 as well as http/1.1, and still
+	// reaches the HTTP server rather than gRPC
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	hc := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   clientTLS,
+		ForceAttemptHTTP2: true,
+	}}
+	defer hc.CloseIdleConnections()
+	res, err := hc.Get(fmt.Sprintf("%s://%s/metrics", scheme, addr))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "proglog_requests_total")
+}
+
+func setupCerts(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mux-test-certs")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	require.NoError(t, config.GenerateCerts(
+		dir,
+		[]string{"localhost", "127.0.0.1"},
+		"root",
+	))
+	return dir
+}
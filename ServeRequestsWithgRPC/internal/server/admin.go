@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+/*
+AdminConfig configures the admin server, which serves the Admin service on
+its own listener so that operators' RPCs can be kept off the address clients
+use.
+*/
+type AdminConfig struct {
+	Log AdminLog
+	// TLS and Authorizer work as they do for the log server. Only
+	// subjects the policy allows the admin action may call the Admin
+	// service.
+	TLS        *tls.Config
+	Authorizer Authorizer
+}
+
+/*
+AdminLog is what the Admin service manages: the log's segments, and its range
+to report after truncating it.
+*/
+type AdminLog interface {
+	Segments() ([]*api.Segment, error)
+	Truncate(lowest uint64) error
+	Roll() (uint64, error)
+	Reset() error
+	Offsets() (low, high uint64, err error)
+}
+
+const adminAction = "admin"
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*AdminConfig
+}
+
+/*
+NewAdminServer(config *AdminConfig) creates a gRPC server serving the Admin
+service. Like the log server, it authenticates every request first.
+*/
+func NewAdminServer(config *AdminConfig) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(authenticateUnary),
+	}
+	if config.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config.TLS)))
+	}
+	gsrv := grpc.NewServer(opts...)
+	api.RegisterAdminServer(gsrv, &adminServer{AdminConfig: config})
+	return gsrv, nil
+}
+
+func (s *adminServer) ListSegments(
+	ctx context.Context,
+	req *api.ListSegmentsRequest,
+) (*api.ListSegmentsResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	segments, err := s.Log.Segments()
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &api.ListSegmentsResponse{Segments: segments}, nil
+}
+
+/*
+Truncate(context.Context, *api.TruncateRequest) removes the old segments. A
+consumer streaming from a removed segment gets an OutOfRange error with the
+log's new range; one reading a removed segment's store through the log's
+reader finishes reading it before its files go.
+*/
+func (s *adminServer) Truncate(
+	ctx context.Context,
+	req *api.TruncateRequest,
+) (*api.TruncateResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.Log.Truncate(req.Lowest); err != nil {
+		return nil, statusError(err)
+	}
+	low, _, err := s.Log.Offsets()
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &api.TruncateResponse{LowOffset: low}, nil
+}
+
+func (s *adminServer) RollActiveSegment(
+	ctx context.Context,
+	req *api.RollActiveSegmentRequest,
+) (*api.RollActiveSegmentResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	base, err := s.Log.Roll()
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &api.RollActiveSegmentResponse{BaseOffset: base}, nil
+}
+
+/*
+Reset(context.Context, *api.ResetRequest) empties the log. Consumers waiting
+for new records get an OutOfRange error, since the offsets start over.
+*/
+func (s *adminServer) Reset(
+	ctx context.Context,
+	req *api.ResetRequest,
+) (*api.ResetResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.Log.Reset(); err != nil {
+		return nil, statusError(err)
+	}
+	return &api.ResetResponse{}, nil
+}
+
+func (s *adminServer) authorize(ctx context.Context) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+	return s.Authorizer.Authorize(subject(ctx), logObject, adminAction)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/SStoyanov22/proglog/internal/auth"
+	"github.com/SStoyanov22/proglog/internal/config"
+	"github.com/SStoyanov22/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+/*
+TestAdmin(*testing.T) tests the Admin service on its own listener: listing
+segments, rolling the active one, truncating the log under a consumer
+streaming from it and resetting it under one waiting for records, and that a
+client without the admin action is denied.
+*/
+func TestAdmin(t *testing.T) {
+	client, nobodyClient, cfg, teardown := setupTest(t, nil)
+	defer teardown()
+	clog := cfg.CommitLog.(*log.Log)
+
+	certDir := genCerts(t)
+	policyFile := path.Join(certDir, "policy.csv")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte("root, *, *\n"), 0644))
+	authorizer, err := auth.New(policyFile)
+	require.NoError(t, err)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.CertFile(certDir, "server"),
+		KeyFile:  config.KeyFile(certDir, "server"),
+		CAFile:   config.CertFile(certDir, "ca"),
+		Server:   true,
+	})
+	require.NoError(t, err)
+	asrv, err := NewAdminServer(&AdminConfig{
+		Log:        clog,
+		TLS:        serverTLSConfig,
+		Authorizer: authorizer,
+	})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go asrv.Serve(l)
+	defer asrv.Stop()
+
+	newAdminClient := func(name string) api.AdminClient {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      config.CertFile(certDir, name+"-client"),
+			KeyFile:       config.KeyFile(certDir, name+"-client"),
+			CAFile:        config.CertFile(certDir, "ca"),
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		cc, err := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() })
+		return api.NewAdminClient(cc)
+	}
+	admin := newAdminClient("root")
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	roll, err := admin.RollActiveSegment(ctx, &api.RollActiveSegmentRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), roll.BaseOffset)
+	list, err := admin.ListSegments(ctx, &api.ListSegmentsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list.Segments))
+	require.Equal(t, uint64(0), list.Segments[0].BaseOffset)
+	require.Equal(t, uint64(3), list.Segments[0].NextOffset)
+	require.Equal(t, uint64(3), list.Segments[0].Records)
+	require.NotZero(t, list.Segments[0].StoreBytes)
+	require.Equal(t, uint64(3), list.Segments[1].BaseOffset)
+
+	// a consumer that's caught up keeps streaming across the truncation,
+	// while one starting from a removed segment learns where the log now
+	// begins
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, res.Record.Offset)
+	}
+	truncate, err := admin.Truncate(ctx, &api.TruncateRequest{Lowest: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), truncate.LowOffset)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Record.Offset)
+
+	late, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = late.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	info := status.Convert(err).Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "3", info.Metadata["low_offset"])
+
+	// a consumer waiting for the next record learns the log started over
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := stream.Recv()
+		waiting <- err
+	}()
+	// give the stream time to start waiting
+	time.Sleep(50 * time.Millisecond)
+	_, err = admin.Reset(ctx, &api.ResetRequest{})
+	require.NoError(t, err)
+	err = <-waiting
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	_, err = newAdminClient("nobody").ListSegments(ctx, &api.ListSegmentsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+}
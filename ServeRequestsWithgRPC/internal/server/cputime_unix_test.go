@@ -0,0 +1,20 @@
+//go:build unix
+
+package server
+
+import (
+	"syscall"
+	"time"
+)
+
+/*
+processCPUTime() returns the CPU time, user and system, the process has used
+so far, and true; where we can't measure it, it returns false instead.
+*/
+func processCPUTime() (time.Duration, bool) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, false
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), true
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"context"
+	"io"
+	"time"
+
+	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const instrumentationName = "github.com/SStoyanov22/proglog/internal/server"
+
+/*
+observer implements the interceptors that give us visibility into the
+server: a structured log line, metrics, and a span for every request. Each
+is optional and on when its part of the server's config is set.
+*/
+type observer struct {
+	logger  *zap.Logger
+	metrics *metrics
+	tracer  trace.Tracer
+}
+
+/*
+newObserver(config *Config) creates an observer for the server's config, or
+returns nil if the config doesn't turn any observability on, in which case
+the server doesn't install its interceptors at all.
+*/
+func newObserver(config *Config) (*observer, error) {
+	if config.Logger == nil && config.Metrics == nil &&
+		config.TracerProvider == nil {
+		return nil, nil
+	}
+	o := &observer{logger: config.Logger}
+	if config.Metrics != nil {
+		m, err := newMetrics(config.Metrics)
+		if err != nil {
+			return nil, err
+		}
+		o.metrics = m
+	}
+	if config.TracerProvider != nil {
+		o.tracer = config.TracerProvider.Tracer(instrumentationName)
+	}
+	return o, nil
+}
+
+/*
+metrics are the Prometheus metrics the server records: how many requests it
+served and how long they took, by method and status code, how many records
+and value bytes clients produced and consumed, and how many streams are open.
+*/
+type metrics struct {
+	requests      *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+	records       *prometheus.CounterVec
+	bytes         *prometheus.CounterVec
+	activeStreams *prometheus.GaugeVec
+}
+
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_requests_total",
+			Help: "Requests served, by gRPC method and status code.",
+		}, []string{"method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proglog_request_duration_seconds",
+			Help:    "How long requests took, by gRPC method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+		records: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_records_total",
+			Help: "Records produced to and consumed from the log.",
+		}, []string{"direction"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_record_bytes_total",
+			Help: "Value bytes produced to and consumed from the log.",
+		}, []string{"direction"}),
+		activeStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proglog_active_streams",
+			Help: "Streams currently open, by gRPC method.",
+		}, []string{"method"}),
+	}
+	for _, c := range []prometheus.Collector{
+		m.requests, m.latency, m.records, m.bytes, m.activeStreams,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+/*
+record(msg interface{}) counts the records in a message that went through the
+server successfully: a produce request the log appended or a consume response
+we sent.
+*/
+func (o *observer) record(msg interface{}) {
+	if o.metrics == nil {
+		return
+	}
+	var direction string
+	var records []*api.Record
+	switch msg := msg.(type) {
+	case *api.ProduceRequest:
+		direction, records = "produced", []*api.Record{msg.Record}
+	case *api.ProduceBatchRequest:
+		direction, records = "produced", msg.Records
+	case *api.ConsumeResponse:
+		direction, records = "consumed", []*api.Record{msg.Record}
+	default:
+		return
+	}
+	for _, r := range records {
+		o.metrics.records.WithLabelValues(direction).Inc()
+		o.metrics.bytes.WithLabelValues(direction).Add(float64(len(r.GetValue())))
+	}
+}
+
+/*
+start(ctx context.Context, method string) starts the request's span, as a
+child of the client's span if the client sent its trace context along in the
+request's metadata.
+*/
+func (o *observer) start(ctx context.Context, method string) (context.Context, trace.Span) {
+	if o.tracer == nil {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = propagation.TraceContext{}.Extract(ctx, metadataCarrier(md))
+	}
+	return o.tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+		),
+	)
+}
+
+/*
+finish(ctx, span, method, start, err) ends the request's span and records its
+outcome in the metrics and the log.
+*/
+func (o *observer) finish(
+	ctx context.Context,
+	span trace.Span,
+	method string,
+	start time.Time,
+	err error,
+) {
+	code := status.Code(err)
+	duration := time.Since(start)
+	if o.tracer != nil {
+		span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(code)))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, code.String())
+		}
+		span.End()
+	}
+	if o.metrics != nil {
+		o.metrics.requests.WithLabelValues(method, code.String()).Inc()
+		o.metrics.latency.WithLabelValues(method).Observe(duration.Seconds())
+	}
+	if o.logger != nil {
+		fields := []zap.Field{
+			zap.String("grpc.method", method),
+			zap.String("grpc.code", code.String()),
+			zap.Duration("grpc.duration", duration),
+			zap.String("peer.subject", subject(ctx)),
+		}
+		if err != nil {
+			o.logger.Warn("request failed", append(fields, zap.Error(err))...)
+		} else {
+			o.logger.Info("request", fields...)
+		}
+	}
+}
+
+func (o *observer) unary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	start := time.Now()
+	ctx, span := o.start(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	if err == nil {
+		o.record(req)
+		o.record(resp)
+	}
+	o.finish(ctx, span, info.FullMethod, start, err)
+	return resp, err
+}
+
+func (o *observer) stream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	start := time.Now()
+	ctx, span := o.start(stream.Context(), info.FullMethod)
+	if o.metrics != nil {
+		streams := o.metrics.activeStreams.WithLabelValues(info.FullMethod)
+		streams.Inc()
+		defer streams.Dec()
+	}
+	err := handler(srv, &observedStream{
+		ServerStream: stream,
+		ctx:          ctx,
+		observer:     o,
+	})
+	o.finish(ctx, span, info.FullMethod, start, err)
+	return err
+}
+
+/*
+observedStream counts the records going through a stream: a produce request's
+once we've sent the response saying the log appended it, and a consume
+response's once we've sent it.
+*/
+type observedStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	observer *observer
+	produce  *api.ProduceRequest
+}
+
+func (s *observedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *observedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if req, ok := m.(*api.ProduceRequest); ok && err == nil {
+		s.produce = req
+	}
+	return err
+}
+
+func (s *observedStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err != nil {
+		return err
+	}
+	switch m.(type) {
+	case *api.ProduceResponse:
+		s.observer.record(s.produce)
+		s.produce = nil
+	case *api.ConsumeResponse:
+		s.observer.record(m)
+	}
+	return nil
+}
+
+/*
+metadataCarrier lets the trace context propagator read gRPC metadata.
+*/
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+/*
+NewTracerProvider(w io.Writer) creates a tracer provider for Config's
+TracerProvider that exports spans as JSON to w, such as stdout or a file. It
+exports them in batches, so shut it down when the server stops to flush the
+last ones.
+*/
+func NewTracerProvider(w io.Writer) (*sdktrace.TracerProvider, error) {
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter)), nil
+}
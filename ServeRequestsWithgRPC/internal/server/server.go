@@ -2,18 +2,107 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"time"
 
 	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type Config struct {
 	CommitLog CommitLog
+	// TLS serves the log over TLS; with ClientAuth set to require and
+	// verify client certificates, as config.SetupTLSConfig sets it for a
+	// server with a CA, clients authenticate with mutual TLS. Nil serves
+	// it in plaintext.
+	TLS *tls.Config
+	// Authorizer decides which clients may produce to and consume from
+	// the log, by the subject they authenticated as. Nil lets every
+	// client do both.
+	Authorizer Authorizer
+	// Logger logs every request, with its method, status code, duration
+	// and the client's subject. Nil turns request logging off.
+	Logger *zap.Logger
+	// Metrics registers the server's request metrics, for a Prometheus
+	// handler to serve. Nil turns metrics off.
+	Metrics prometheus.Registerer
+	// TracerProvider traces every request with a span; NewTracerProvider
+	// makes one that exports them to a file or stdout. Nil turns
+	// tracing off.
+	TracerProvider trace.TracerProvider
+	// Draining, once closed, ends the consume streams, including those
+	// waiting for records to be appended, which would otherwise hold up
+	// a graceful stop forever. Nil never ends them.
+	Draining <-chan struct{}
+	// MaxRecordBytes rejects records larger than this, encoded, with
+	// InvalidArgument before they reach the log, and raises the size of
+	// message the server receives so that a record this large fits in
+	// one. Zero leaves record sizes to the log and messages at gRPC's
+	// default limit.
+	MaxRecordBytes int
+	// GetServerer lists the servers in the cluster for GetServers, which
+	// clients discover the cluster and its leader with. Nil fails
+	// GetServers with Unimplemented, for a server that isn't part of a
+	// cluster.
+	GetServerer GetServerer
 }
 
+/*
+gRPC rejects messages larger than defaultMaxRecvMsgSize unless the server
+raises the limit. A produce request wraps its record in a few bytes more, so
+we leave messageOverhead of room on top of the max record size.
+*/
+const (
+	defaultMaxRecvMsgSize = 4 << 20
+	messageOverhead       = 1 << 10
+)
+
+/*
+Authorizer returns nil if the subject may perform the action on the object,
+and a PermissionDenied status error if it may not.
+*/
+type Authorizer interface {
+	Authorize(subject, object, action string) error
+}
+
+/*
+The log is the only object clients act on so far, so every action is
+authorized on logObject.
+*/
+const (
+	logObject     = "log"
+	produceAction = "produce"
+	consumeAction = "consume"
+)
+
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	Durability() api.Durability
+	OffsetForTime(time.Time) (uint64, error)
+	WaitForOffset(context.Context, uint64) error
+	// Offsets returns the log's lowest offset and the offset its next
+	// record will get.
+	Offsets() (low, high uint64, err error)
+	Stats() (*api.LogStats, error)
+}
+
+/*
+GetServerer lists the servers in the cluster, like DistributedLog does with
+Raft's configuration.
+*/
+type GetServerer interface {
+	GetServers() ([]*api.Server, error)
 }
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -30,8 +119,36 @@ func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 	return srv, nil
 }
 
+/*
+NewGRPCServer(config *Config) creates a gRPC server serving the log. Every
+request goes through the authenticate interceptors first, which record the
+client's subject in the request's context, and then through the
+observability interceptors, if the config turns any observability on.
+*/
 func NewGRPCServer(config *Config) (*grpc.Server, error) {
-	gsrv := grpc.NewServer()
+	unary := []grpc.UnaryServerInterceptor{authenticateUnary}
+	stream := []grpc.StreamServerInterceptor{authenticateStream}
+	o, err := newObserver(config)
+	if err != nil {
+		return nil, err
+	}
+	if o != nil {
+		unary = append(unary, o.unary)
+		stream = append(stream, o.stream)
+	}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	}
+	if config.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config.TLS)))
+	}
+	// a smaller max record size doesn't lower the limit, since a batch of
+	// small records can still make a large message
+	if n := config.MaxRecordBytes + messageOverhead; n > defaultMaxRecvMsgSize {
+		opts = append(opts, grpc.MaxRecvMsgSize(n))
+	}
+	gsrv := grpc.NewServer(opts...)
 	srv, err := newgrpcServer(config)
 	if err != nil {
 		return nil, err
@@ -42,22 +159,144 @@ func NewGRPCServer(config *Config) (*grpc.Server, error) {
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	*api.ProduceResponse, error) {
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkSize(req.Record); err != nil {
+		return nil, err
+	}
 	offset, err := s.CommitLog.Append(req.Record)
 	if err != nil {
+		return nil, statusError(err)
+	}
+	return &api.ProduceResponse{
+		Offset:     offset,
+		Durability: s.CommitLog.Durability(),
+	}, nil
+}
+
+/*
+ProduceBatch(context.Context, *api.ProduceBatchRequest) appends the request's
+records to the log together and returns the offsets of the first and last of
+them; the records in between got the offsets in between.
+*/
+func (s *grpcServer) ProduceBatch(
+	ctx context.Context,
+	req *api.ProduceBatchRequest,
+) (*api.ProduceBatchResponse, error) {
+	if err := s.authorize(ctx, produceAction); err != nil {
 		return nil, err
 	}
-	return &api.ProduceResponse{Offset: offset}, nil
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "empty record batch")
+	}
+	for _, record := range req.Records {
+		if err := s.checkSize(record); err != nil {
+			return nil, err
+		}
+	}
+	offset, err := s.CommitLog.AppendBatch(req.Records)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &api.ProduceBatchResponse{
+		BaseOffset: offset,
+		LastOffset: offset + uint64(len(req.Records)) - 1,
+		Durability: s.CommitLog.Durability(),
+	}, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
 	record, err := s.CommitLog.Read(req.Offset)
 	if err != nil {
-		return nil, err
+		return nil, statusError(err)
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+/*
+GetOffsetForTime(context.Context, *api.GetOffsetForTimeRequest) finds the
+offset to consume from to read every record appended since the given time.
+*/
+func (s *grpcServer) GetOffsetForTime(
+	ctx context.Context,
+	req *api.GetOffsetForTimeRequest,
+) (*api.GetOffsetForTimeResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	offset, err := s.CommitLog.OffsetForTime(req.Timestamp.AsTime())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &api.GetOffsetForTimeResponse{Offset: offset}, nil
+}
+
+/*
+GetOffsets(context.Context, *api.GetOffsetsRequest) returns the log's range,
+so a client can find where the log begins and ends without probing it.
+*/
+func (s *grpcServer) GetOffsets(
+	ctx context.Context,
+	req *api.GetOffsetsRequest,
+) (*api.GetOffsetsResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	low, high, err := s.CommitLog.Offsets()
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &api.GetOffsetsResponse{LowOffset: low, HighOffset: high}, nil
+}
+
+/*
+GetLogStats(context.Context, *api.GetLogStatsRequest) describes the log: its
+range, its segments and their size, and how fast it's being appended to.
+*/
+func (s *grpcServer) GetLogStats(
+	ctx context.Context,
+	req *api.GetLogStatsRequest,
+) (*api.GetLogStatsResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	stats, err := s.CommitLog.Stats()
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &api.GetLogStatsResponse{Stats: stats}, nil
+}
+
+/*
+GetServers(context.Context, *api.GetServersRequest) lists the servers in the
+cluster and which of them is the leader, so a client that knows one server
+can find the rest, and send its records to the leader.
+*/
+func (s *grpcServer) GetServers(
+	ctx context.Context,
+	req *api.GetServersRequest,
+) (*api.GetServersResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.GetServerer == nil {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"the server isn't part of a cluster",
+		)
+	}
+	servers, err := s.GetServerer.GetServers()
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
 /*
 ProduceStream(api.Log_ProduceStreamServer) implements a bidirectional streaming
 RPC so the client can stream data into the server’s log and the server can tell
@@ -88,21 +327,38 @@ server where in the log to read records, and then the serverwill
 stream every record that follows—even records that aren’t in the
 log yet! When the server reaches the end of the log, the server will
 wait until someone appends a record to the log and then continue
-streaming records to the client.
+streaming records to the client. The commit log wakes us when that
+happens, so an idle stream just sleeps rather than polling the log. When the
+server starts draining, we end the stream as if the client had gone.
 */
 func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	if s.Draining != nil {
+		go func() {
+			select {
+			case <-s.Draining:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
 	for {
 		select {
-		case <-stream.Context().Done():
+		case <-ctx.Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			res, err := s.Consume(ctx, req)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				err = s.CommitLog.WaitForOffset(ctx, req.Offset)
+				if err != nil && ctx.Err() == nil {
+					return statusError(err)
+				}
 				continue
 			default:
 				return err
@@ -110,7 +366,129 @@ func (s *grpcServer) ConsumeStream(
 			if err = stream.Send(res); err != nil {
 				return err
 			}
-			req.Offset++
+			// compaction can leave gaps, so we carry on from after the
+			// record we got rather than the offset we asked for
+			req.Offset = res.Record.Offset + 1
 		}
 	}
 }
+
+/*
+checkSize(record *api.Record) returns an api.ErrRecordTooLarge, which clients
+get as InvalidArgument, if the record is larger than the configured maximum.
+*/
+func (s *grpcServer) checkSize(record *api.Record) error {
+	if s.MaxRecordBytes == 0 {
+		return nil
+	}
+	if n := proto.Size(record); n > s.MaxRecordBytes {
+		return api.ErrRecordTooLarge{
+			Size: uint64(n),
+			Max:  uint64(s.MaxRecordBytes),
+			Unit: "bytes",
+		}
+	}
+	return nil
+}
+
+/*
+statusError(err error) returns an error from the commit log as a gRPC status
+error. The log's own errors, from api/v1, already carry their status, with a
+standard code and details, so they pass through as they are. A context error
+gets the matching Canceled or DeadlineExceeded code, and anything else is an
+Internal error, since it's a failure on our side that the log didn't
+classify, rather than the Unknown code gRPC would give it.
+*/
+func statusError(err error) error {
+	if _, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+		return err
+	}
+	if errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+/*
+authorize(ctx context.Context, action string) checks that the client making
+the request may perform the action on the log. The stream RPCs go through
+Produce and Consume, so they're authorized for every message.
+*/
+func (s *grpcServer) authorize(ctx context.Context, action string) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+	return s.Authorizer.Authorize(subject(ctx), logObject, action)
+}
+
+type subjectContextKey struct{}
+
+/*
+subject(ctx context.Context) returns the subject of the client making the
+request: the common name of the certificate it authenticated with, or the
+empty string if it didn't present one.
+*/
+func subject(ctx context.Context) string {
+	s, _ := ctx.Value(subjectContextKey{}).(string)
+	return s
+}
+
+/*
+authenticate(ctx context.Context) reads the client's subject from the
+certificate it verified with over mutual TLS and adds it to the context.
+*/
+func authenticate(ctx context.Context) (context.Context, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx, status.New(
+			codes.Unknown,
+			"couldn't find peer info",
+		).Err()
+	}
+	var subject string
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok &&
+		len(tlsInfo.State.VerifiedChains) > 0 &&
+		len(tlsInfo.State.VerifiedChains[0]) > 0 {
+		subject = tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	}
+	return context.WithValue(ctx, subjectContextKey{}, subject), nil
+}
+
+func authenticateUnary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, err := authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func authenticateStream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, err := authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ServerStream: stream, ctx: ctx})
+}
+
+/*
+serverStream is a grpc.ServerStream whose context the interceptors replaced.
+*/
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -2,49 +2,347 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
 	"io/ioutil"
 	"net"
+	"os"
+	"path"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/SStoyanov22/proglog/api/v1"
+	"github.com/SStoyanov22/proglog/internal/auth"
+	"github.com/SStoyanov22/proglog/internal/config"
 	"github.com/SStoyanov22/proglog/internal/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	zapobserver "go.uber.org/zap/zaptest/observer"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestServer(t *testing.T) {
 	for scenario, fn := range map[string]func(
 		t *testing.T,
-		client api.LogClient,
+		client, nobodyClient api.LogClient,
 		config *Config,
 	){
 		"produce/consume a message to/from the log succeeeds": testProduceConsume,
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"consume past log boundary fails":                     testConsumePastBoundary,
+		"get offset for time succeeds":                        testGetOffsetForTime,
+		"produce batch succeeds":                              testProduceBatch,
+		"get offsets and log stats succeeds":                  testGetOffsetsAndStats,
+		"idle consume streams don't burn CPU":                 testIdleConsumeStreams,
+		"get servers outside a cluster fails":                 testGetServersWithoutCluster,
+		"unauthorized fails":                                  testUnauthorized,
 	} {
 		t.Run(scenario, func(t *testing.T) {
-			client, config, teardown := setupTest(t, nil)
+			client, nobodyClient, config, teardown := setupTest(t, nil)
 			defer teardown()
-			fn(t, client, config)
+			fn(t, client, nobodyClient, config)
 		})
 	}
 }
 
+/*
+TestObservability(*testing.T) tests that with logging, metrics and tracing
+turned on, the server logs, counts and traces each request, and counts the
+records going through the streams as well as the unary RPCs.
+*/
+func TestObservability(t *testing.T) {
+	core, logs := zapobserver.New(zap.InfoLevel)
+	registry := prometheus.NewRegistry()
+	spans := tracetest.NewSpanRecorder()
+	client, nobodyClient, _, teardown := setupTest(t, func(config *Config) {
+		config.Logger = zap.New(core)
+		config.Metrics = registry
+		config.TracerProvider = sdktrace.NewTracerProvider(
+			sdktrace.WithSpanProcessor(spans),
+		)
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+	_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.Error(t, err)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	produce := "/log.v1.Log/Produce"
+	consumeStream := "/log.v1.Log/ConsumeStream"
+	require.Equal(t, 1.0, metricValue(registry, "proglog_active_streams",
+		prometheus.Labels{"method": consumeStream}))
+	// the stream counts a record once its send returns, which can be after
+	// the client has it
+	for _, direction := range []string{"produced", "consumed"} {
+		labels := prometheus.Labels{"direction": direction}
+		require.Eventually(t, func() bool {
+			return metricValue(registry, "proglog_records_total", labels) == 1
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, float64(len(record.Value)),
+			metricValue(registry, "proglog_record_bytes_total", labels))
+	}
+	for _, code := range []string{"OK", "PermissionDenied"} {
+		require.Equal(t, 1.0, metricValue(registry, "proglog_requests_total",
+			prometheus.Labels{"method": produce, "code": code}))
+	}
+
+	entries := logs.FilterField(zap.String("grpc.method", produce)).All()
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, "root", entries[0].ContextMap()["peer.subject"])
+	require.Equal(t, zap.WarnLevel, entries[1].Level)
+
+	ended := spans.Ended()
+	require.Equal(t, 2, len(ended))
+	require.Equal(t, produce, ended[0].Name())
+	require.Equal(t, otelcodes.Error, ended[1].Status().Code)
+}
+
+/*
+metricValue(registry, name, labels) returns the current value of the counter
+or gauge with the given name and labels in the registry.
+*/
+func metricValue(
+	registry *prometheus.Registry,
+	name string,
+	labels prometheus.Labels,
+) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		return -1
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.Metric {
+			match := len(m.Label) == len(labels)
+			for _, label := range m.Label {
+				if labels[label.GetName()] != label.GetValue() {
+					match = false
+				}
+			}
+			if !match {
+				continue
+			}
+			if m.Counter != nil {
+				return m.Counter.GetValue()
+			}
+			return m.Gauge.GetValue()
+		}
+	}
+	return 0
+}
+
+/*
+TestDraining(*testing.T) tests that draining the server ends a consume stream
+that's waiting for records, so that a graceful stop doesn't wait on it.
+*/
+func TestDraining(t *testing.T) {
+	draining := make(chan struct{})
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.Draining = draining
+	})
+	defer teardown()
+
+	stream, err := client.ConsumeStream(
+		context.Background(),
+		&api.ConsumeRequest{Offset: 0},
+	)
+	require.NoError(t, err)
+	close(draining)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+/*
+TestMaxRecordBytes(*testing.T) tests that the server takes a record larger
+than gRPC's default message limit when the max record size allows it, and
+rejects one larger than the max record size, alone or in a batch, with
+InvalidArgument.
+*/
+func TestMaxRecordBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max-record-bytes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16 << 20
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	max := 5 << 20
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.CommitLog = clog
+		config.MaxRecordBytes = max
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	value := make([]byte, max-100)
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: value},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(
+		ctx,
+		&api.ConsumeRequest{Offset: produce.Offset},
+		grpc.MaxCallRecvMsgSize(2*max),
+	)
+	require.NoError(t, err)
+	require.Equal(t, len(value), len(consume.Record.Value))
+
+	large := &api.Record{Value: make([]byte, max)}
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: large})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	info := status.Convert(err).Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "RECORD_TOO_LARGE", info.Reason)
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{{Value: []byte("small")}, large},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+/*
+TestStatusError(*testing.T) tests that errors from the commit log reach
+clients with a standard code: the log's own errors with theirs, context
+errors with the matching one, and anything else as Internal.
+*/
+func TestStatusError(t *testing.T) {
+	for err, want := range map[error]codes.Code{
+		api.ErrOffsetOutOfRange{Offset: 1}:     codes.OutOfRange,
+		api.ErrCorruptRecord{Offset: 1}:        codes.DataLoss,
+		api.ErrLogClosed{}:                     codes.FailedPrecondition,
+		api.ErrRecordTooLarge{Size: 2, Max: 1}: codes.InvalidArgument,
+		api.ErrUnavailable{Err: io.EOF}:        codes.Unavailable,
+		context.Canceled:                       codes.Canceled,
+		context.DeadlineExceeded:               codes.DeadlineExceeded,
+		io.ErrUnexpectedEOF:                    codes.Internal,
+	} {
+		require.Equal(t, want, status.Code(statusError(err)), "%v", err)
+	}
+}
+
+/*
+TestAuthenticate(*testing.T) tests that authenticating a request records the
+common name of the client's verified certificate as its subject, and no
+subject for a client that didn't present one.
+*/
+func TestAuthenticate(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "root"}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}},
+	})
+	ctx, err := authenticate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "root", subject(ctx))
+
+	ctx = peer.NewContext(context.Background(), &peer.Peer{})
+	ctx, err = authenticate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "", subject(ctx))
+
+	_, err = authenticate(context.Background())
+	require.Error(t, err)
+}
+
+/*
+TestAuthorizeObject(*testing.T) tests that the server authorizes each action
+on the log as the object, with the client's subject.
+*/
+func TestAuthorizeObject(t *testing.T) {
+	authorizer := &recordingAuthorizer{}
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.Authorizer = authorizer
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"root, log, produce",
+		"root, log, consume",
+	}, authorizer.calls)
+}
+
+/*
+recordingAuthorizer records what it was asked to authorize, and allows it.
+*/
+type recordingAuthorizer struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (a *recordingAuthorizer) Authorize(subject, object, action string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, subject+", "+object+", "+action)
+	return nil
+}
+
 // END: intro
 
 // START: setup
 func setupTest(t *testing.T, fn func(*Config)) (
-	client api.LogClient,
-	config *Config,
+	rootClient api.LogClient,
+	nobodyClient api.LogClient,
+	cfg *Config,
 	teardown func(),
 ) {
 	t.Helper()
 
-	l, err := net.Listen("tcp", ":0")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
 
-	clientOptions := []grpc.DialOption{grpc.WithInsecure()}
-	cc, err := grpc.Dial(l.Addr().String(), clientOptions...)
+	certDir := genCerts(t)
+	newClient := func(name string) (*grpc.ClientConn, api.LogClient) {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      config.CertFile(certDir, name+"-client"),
+			KeyFile:       config.KeyFile(certDir, name+"-client"),
+			CAFile:        config.CertFile(certDir, "ca"),
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		opts := []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		}
+		cc, err := grpc.Dial(l.Addr().String(), opts...)
+		require.NoError(t, err)
+		return cc, api.NewLogClient(cc)
+	}
+	rootConn, rootClient := newClient("root")
+	nobodyConn, nobodyClient := newClient("nobody")
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.CertFile(certDir, "server"),
+		KeyFile:  config.KeyFile(certDir, "server"),
+		CAFile:   config.CertFile(certDir, "ca"),
+		Server:   true,
+	})
 	require.NoError(t, err)
 
 	dir, err := ioutil.TempDir("", "server-test")
@@ -53,33 +351,64 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	clog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
-	config = &Config{
-		CommitLog: clog,
+	policyFile := path.Join(certDir, "policy.csv")
+	require.NoError(t, ioutil.WriteFile(
+		policyFile,
+		[]byte("root, *, *\nnobody, log, consume\nnobody, topic, produce\n"),
+		0644,
+	))
+	authorizer, err := auth.New(policyFile)
+	require.NoError(t, err)
+
+	cfg = &Config{
+		CommitLog:  clog,
+		TLS:        serverTLSConfig,
+		Authorizer: authorizer,
 	}
 	if fn != nil {
-		fn(config)
+		fn(cfg)
 	}
-	server, err := NewGRPCServer(config)
+	server, err := NewGRPCServer(cfg)
 	require.NoError(t, err)
 
 	go func() {
 		server.Serve(l)
 	}()
 
-	client = api.NewLogClient(cc)
-
-	return client, config, func() {
+	return rootClient, nobodyClient, cfg, func() {
 		server.Stop()
-		cc.Close()
+		rootConn.Close()
+		nobodyConn.Close()
 		l.Close()
 		clog.Remove()
 	}
 }
 
+/*
+genCerts(*testing.T) generates the CA and the certificates the tests' server
+and clients use for mutual TLS in a temporary directory and returns it.
+*/
+func genCerts(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "server-test-certs")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	require.NoError(t, config.GenerateCerts(
+		dir,
+		[]string{"localhost", "127.0.0.1"},
+		"root", "nobody",
+	))
+	return dir
+}
+
 // END: setup
 
 // START: produceconsume
-func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
+func testProduceConsume(
+	t *testing.T,
+	client, nobodyClient api.LogClient,
+	config *Config,
+) {
 	ctx := context.Background()
 
 	want := &api.Record{
@@ -93,6 +422,7 @@ func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
 		},
 	)
 	require.NoError(t, err)
+	require.Equal(t, api.Durability_DURABILITY_NONE, produce.Durability)
 
 	consume, err := client.Consume(ctx, &api.ConsumeRequest{
 		Offset: produce.Offset,
@@ -107,7 +437,7 @@ func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
 // START: consumeerror
 func testConsumePastBoundary(
 	t *testing.T,
-	client api.LogClient,
+	client, nobodyClient api.LogClient,
 	config *Config,
 ) {
 	ctx := context.Background()
@@ -130,6 +460,11 @@ func testConsumePastBoundary(
 	if got != want {
 		t.Fatalf("got err: %v, want: %v", got, want)
 	}
+	require.Equal(t, codes.OutOfRange, got)
+	info := status.Convert(err).Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "OFFSET_OUT_OF_RANGE", info.Reason)
+	require.Equal(t, "0", info.Metadata["low_offset"])
+	require.Equal(t, "1", info.Metadata["high_offset"])
 }
 
 // END: consumeerror
@@ -137,7 +472,7 @@ func testConsumePastBoundary(
 // START: stream
 func testProduceConsumeStream(
 	t *testing.T,
-	client api.LogClient,
+	client, nobodyClient api.LogClient,
 	config *Config,
 ) {
 	ctx := context.Background()
@@ -182,10 +517,213 @@ func testProduceConsumeStream(
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotNil(t, res.Record.Timestamp)
 		}
 	}
 }
+
+func testGetOffsetForTime(
+	t *testing.T,
+	client, nobodyClient api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:     []byte("hello world"),
+				Timestamp: timestamppb.New(start.Add(time.Duration(i) * time.Minute)),
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.GetOffsetForTime(ctx, &api.GetOffsetForTimeRequest{
+		Timestamp: timestamppb.New(start.Add(30 * time.Second)),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	res, err = client.GetOffsetForTime(ctx, &api.GetOffsetForTimeRequest{
+		Timestamp: timestamppb.Now(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Offset)
+}
+
+/*
+testGetOffsetsAndStats(*testing.T, api.LogClient, api.LogClient, *Config)
+tests that a client that may consume can get the log's range, empty and after
+producing, and its stats.
+*/
+func testGetOffsetsAndStats(
+	t *testing.T,
+	client, nobodyClient api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	offsets, err := nobodyClient.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.LowOffset)
+	require.Equal(t, uint64(0), offsets.HighOffset)
+
+	for i := 0; i < 3; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	offsets, err = nobodyClient.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.LowOffset)
+	require.Equal(t, uint64(3), offsets.HighOffset)
+
+	res, err := nobodyClient.GetLogStats(ctx, &api.GetLogStatsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Stats.LowOffset)
+	require.Equal(t, uint64(3), res.Stats.HighOffset)
+	require.Equal(t, uint64(1), res.Stats.Segments)
+	require.NotZero(t, res.Stats.Bytes)
+	require.Greater(t, res.Stats.AppendRate, 0.0)
+}
+
+func testGetServersWithoutCluster(
+	t *testing.T,
+	client, nobodyClient api.LogClient,
+	config *Config,
+) {
+	_, err := client.GetServers(
+		context.Background(),
+		&api.GetServersRequest{},
+	)
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func testProduceBatch(
+	t *testing.T,
+	client, nobodyClient api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("first")},
+	})
+	require.NoError(t, err)
+
+	records := []*api.Record{
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+		{Value: []byte("fourth")},
+	}
+	res, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.BaseOffset)
+	require.Equal(t, uint64(3), res.LastOffset)
+	require.Equal(t, api.Durability_DURABILITY_NONE, res.Durability)
+
+	for i, record := range records {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset: res.BaseOffset + uint64(i),
+		})
+		require.NoError(t, err)
+		require.Equal(t, record.Value, consume.Record.Value)
+		require.Equal(t, res.BaseOffset+uint64(i), consume.Record.Offset)
+	}
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the log's default index only has room for 85 records
+	records = make([]*api.Record, 86)
+	for i := range records {
+		records[i] = &api.Record{Value: []byte("too many")}
+	}
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	info := status.Convert(err).Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "RECORD_TOO_LARGE", info.Reason)
+}
+
+/*
+testIdleConsumeStreams(*testing.T, api.LogClient, *Config) tests that streams
+that have caught up with the log sleep until a record is appended rather than
+polling for it, by measuring the CPU time the process uses while a hundred of
+them sit idle, and that every one of them then gets the record.
+*/
+func testIdleConsumeStreams(
+	t *testing.T,
+	client, nobodyClient api.LogClient,
+	config *Config,
+) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	streams := make([]api.Log_ConsumeStreamClient, 100)
+	for i := range streams {
+		stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+		require.NoError(t, err)
+		streams[i] = stream
+	}
+	// give the server time to start every stream and reach the end of the log
+	time.Sleep(100 * time.Millisecond)
+
+	// where we can't measure the CPU time, we only check the streams get
+	// the record
+	if before, ok := processCPUTime(); ok {
+		time.Sleep(500 * time.Millisecond)
+		after, _ := processCPUTime()
+		require.Less(t, after-before, 100*time.Millisecond)
+	}
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	for _, stream := range streams {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), res.Record.Value)
+	}
+}
+
+/*
+testUnauthorized(*testing.T, api.LogClient, api.LogClient, *Config) tests that
+a client the policy only lets consume is denied when it produces, on its own
+or in a stream, but can still consume.
+*/
+func testUnauthorized(
+	t *testing.T,
+	client, nobodyClient api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+
+	_, err := nobodyClient.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{record},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	stream, err := nobodyClient.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{Record: record}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+	res, err := nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, record.Value, res.Record.Value)
+}